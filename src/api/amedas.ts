@@ -0,0 +1,91 @@
+import { Temporal } from "@js-temporal/polyfill";
+import { JsonApi } from "./jsonApi";
+
+interface RawAmedasPoint {
+    type: string;
+    elems: string;
+    kjName: string; // e.g. 東京
+    knName: string;
+    enName: string;
+}
+
+// Observations are [value, quality flag]. Missing elements are omitted.
+interface RawObservation {
+    temp?: [number | null, number];
+    precipitation10m?: [number | null, number];
+    sun10m?: [number | null, number];
+}
+
+export interface AmedasPoint {
+    code: string;
+    name: string;
+}
+
+export interface PastWeather {
+    pointName: string;
+    date: string; // YYYY-MM-DD
+    maxTemp?: number;
+    minTemp?: number;
+    precipitation?: number; // Total of the day in mm
+    sunshineHours?: number;
+    partial: boolean; // true for today, which only has observations until now
+}
+
+// Point data are split into files of 3 hours, named by the starting hour.
+const BLOCK_HOURS = [0, 3, 6, 9, 12, 15, 18, 21];
+
+// Client of AMeDAS observations published by JMA.
+export class AmedasApi {
+    private readonly constApi: JsonApi;
+    private readonly dataApi: JsonApi;
+    private points?: Record<string, RawAmedasPoint>;
+
+    constructor() {
+        this.constApi = new JsonApi('https://www.jma.go.jp/bosai/amedas/const');
+        this.dataApi = new JsonApi('https://www.jma.go.jp/bosai/amedas/data');
+    }
+
+    // Finds observation points by name. Exact matches come first.
+    async findPoints(name: string, signal?: AbortSignal): Promise<AmedasPoint[]> {
+        if (this.points === undefined) {
+            this.points = await this.constApi.getWithSignal<Record<string, RawAmedasPoint>>('/amedastable.json', signal);
+        }
+        const matches = Object.entries(this.points)
+            .filter(([, p]) => p.kjName.includes(name) || name.includes(p.kjName))
+            .map(([code, p]) => ({ code, name: p.kjName }));
+        return matches.sort((a, b) => Number(b.name === name) - Number(a.name === name));
+    }
+
+    // date is YYYY-MM-DD in JST. Only recent days are available from JMA.
+    async getPastWeather(point: AmedasPoint, date: string, signal?: AbortSignal): Promise<PastWeather> {
+        const day = Temporal.PlainDate.from(date);
+        const now = Temporal.Now.zonedDateTimeISO('Asia/Tokyo');
+        const today = now.toPlainDate();
+        if (Temporal.PlainDate.compare(day, today) > 0) {
+            throw new Error(`Date is in the future: ${date}`);
+        }
+
+        const isToday = day.equals(today);
+        const hours = isToday ? BLOCK_HOURS.filter((h) => h <= now.hour) : BLOCK_HOURS;
+        const yyyymmdd = day.toString().replaceAll('-', '');
+        const blocks = await Promise.all(hours.map((h) =>
+            this.dataApi.getWithSignal<Record<string, RawObservation>>(`/point/${point.code}/${yyyymmdd}_${h.toString().padStart(2, '0')}.json`, signal)));
+        const observations = blocks.flatMap((b) => Object.values(b));
+
+        const values = (key: keyof RawObservation) => observations
+            .map((o) => o[key]?.[0])
+            .filter((v): v is number => v !== undefined && v !== null);
+        const temps = values('temp');
+        const precipitations = values('precipitation10m');
+        const sunshines = values('sun10m'); // Minutes in 10 minutes
+        return {
+            pointName: point.name,
+            date: day.toString(),
+            maxTemp: temps.length > 0 ? Math.max(...temps) : undefined,
+            minTemp: temps.length > 0 ? Math.min(...temps) : undefined,
+            precipitation: precipitations.length > 0 ? Math.round(precipitations.reduce((a, b) => a + b, 0) * 10) / 10 : undefined,
+            sunshineHours: sunshines.length > 0 ? Math.round(sunshines.reduce((a, b) => a + b, 0) / 6) / 10 : undefined,
+            partial: isToday,
+        };
+    }
+}
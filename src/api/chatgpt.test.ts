@@ -0,0 +1,101 @@
+import { afterEach, before, describe, mock, test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import { mkdtempSync, writeFileSync } from 'fs';
+import { tmpdir } from 'os';
+import { join } from 'path';
+import type { AssistantMessage, ToolMessage } from './chatgpt';
+import { getPersona, DEFAULT_PERSONA } from '../persona';
+import { ReplyLength } from '../stateStore';
+
+let chatgpt: typeof import('./chatgpt');
+
+function completion(message: AssistantMessage): Response {
+    return new Response(JSON.stringify({
+        id: 'chatcmpl-test',
+        choices: [{ index: 0, message, finish_reason: message.tool_calls ? 'tool_calls' : 'stop' }],
+        created: 0,
+        model: 'gpt-4o-mini',
+        system_fingerprint: '',
+        object: 'chat.completion',
+        usage: { prompt_tokens: 10, completion_tokens: 10, total_tokens: 20 },
+    }), { status: 200 });
+}
+
+// Makes ChatGPT call set_reply_length with the arguments, then answer with a text
+function mockSetReplyLength(args: object) {
+    const responses = [
+        completion({
+            role: 'assistant',
+            content: null,
+            tool_calls: [{ id: 'call_1', type: 'function', function: { name: 'set_reply_length', arguments: JSON.stringify(args) } }],
+        }),
+        completion({ role: 'assistant', content: 'わかったロボ' }),
+    ];
+    mock.method(globalThis, 'fetch', async () => responses.shift());
+}
+
+describe('set_reply_length', () => {
+    before(() => {
+        // globalContext, which chatgpt depends on, reads env.json in the working directory on load
+        process.chdir(mkdtempSync(join(tmpdir(), 'teobot-env-')));
+        writeFileSync('env.json', JSON.stringify({
+            CHAT_GPT_API_KEY: 'test',
+            MASTODON_BASE_URL: 'https://mastodon.example',
+            MASTODON_CLIENT_KEY: 'test',
+            MASTODON_CLIENT_SECRET: 'test',
+            MASTODON_ACCESS_TOKEN: 'test',
+            TEOKURE_STORAGE_PATH: '.',
+            BUILD_TIMESTAMP: 0,
+        }));
+        // eslint-disable-next-line @typescript-eslint/no-var-requires
+        require('../globalContext');
+        // eslint-disable-next-line @typescript-eslint/no-var-requires
+        chatgpt = require('./chatgpt');
+    });
+
+    afterEach(() => {
+        mock.restoreAll();
+    });
+
+    test('saves the preference of the interlocutor', async () => {
+        const saved: [string, ReplyLength][] = [];
+        const client = new chatgpt.ChatGPT('test', {
+            userPreferences: { setReplyLength: async (acct, length) => { saved.push([acct, length]); } },
+        });
+        const context = { ...client.newChatContext(getPersona(DEFAULT_PERSONA)), interlocutorAcct: 'alice@remote.example' };
+        mockSetReplyLength({ length: 'short' });
+
+        const response = await client.chat(context, { role: 'user', content: '短くして' });
+
+        assert.equal(response.message.content, 'わかったロボ');
+        assert.deepEqual(saved, [['alice@remote.example', 'short']]);
+    });
+
+    test('does not save in dry run', async () => {
+        const saved: [string, ReplyLength][] = [];
+        const client = new chatgpt.ChatGPT('test', {
+            userPreferences: { setReplyLength: async (acct, length) => { saved.push([acct, length]); } },
+        });
+        const context = { ...client.newChatContext(getPersona(DEFAULT_PERSONA)), interlocutorAcct: 'alice', dryRun: true };
+        mockSetReplyLength({ length: 'long' });
+
+        await client.chat(context, { role: 'user', content: '詳しくして' });
+
+        assert.deepEqual(saved, []);
+    });
+
+    test('rejects an unknown length', async () => {
+        const saved: [string, ReplyLength][] = [];
+        const client = new chatgpt.ChatGPT('test', {
+            userPreferences: { setReplyLength: async (acct, length) => { saved.push([acct, length]); } },
+        });
+        const context = { ...client.newChatContext(getPersona(DEFAULT_PERSONA)), interlocutorAcct: 'alice' };
+        mockSetReplyLength({ length: 'tiny' });
+
+        const response = await client.chat(context, { role: 'user', content: 'ちょうどよくして' });
+
+        assert.deepEqual(saved, []);
+        const toolMessage = response.newContext.history.find((m): m is ToolMessage => m.role === 'tool');
+        assert.match(toolMessage!.content, /error/);
+    });
+});
@@ -1,7 +1,16 @@
 import { Temporal } from "@js-temporal/polyfill";
 import { Logger } from "../logging";
 import { env } from '../globalContext';
-import { JmaApi } from "./jma";
+import { JmaApi, UnknownAreaError } from "./jma";
+import { AmedasApi } from "./amedas";
+import { Mastodon } from "./mastodon";
+import { stripHtmlTags } from "../messageUtil";
+import { HttpApiError, anySignal, withRequestSignal } from "../util";
+import { ReplyLength } from "../stateStore";
+import { validateToolArguments } from "./toolSchema";
+import { Persona, personaInstruction } from "../persona";
+import { setTimeout } from 'timers/promises';
+import { mkdir, writeFile } from 'fs/promises';
 
 type Role = 'system' | 'user' | 'assistant' | 'tool';
 
@@ -33,12 +42,35 @@ export interface SystemMessage {
     name?: string;
 }
 
+export type ContentPart =
+    | { type: 'text', text: string }
+    | { type: 'image_url', image_url: { url: string, detail?: 'low' | 'high' | 'auto' } };
+
 export interface UserMessage {
     role: Extract<Role, 'user'>;
-    content: string;
+    content: string | ContentPart[]; // Parts are used to pass images to models with vision
     name?: string;
 }
 
+// Returns the text part of the content, dropping images.
+export function textOf(content: string | ContentPart[] | null | undefined): string {
+    if (content === null || content === undefined || typeof content === 'string') {
+        return content ?? '';
+    }
+    return content.map((p) => p.type === 'text' ? p.text : '').join('');
+}
+
+// Builds a user message content with images. Images are passed in low detail to keep the cost fixed and small.
+export function contentWithImages(text: string, imageUrls: string[]): string | ContentPart[] {
+    if (imageUrls.length === 0) {
+        return text;
+    }
+    return [
+        { type: 'text', text },
+        ...imageUrls.map((url) => ({ type: 'image_url', image_url: { url, detail: 'low' } } satisfies ContentPart)),
+    ];
+}
+
 export interface AssistantMessage {
     role: Extract<Role, 'assistant'>;
     content?: string | null;
@@ -78,113 +110,508 @@ export interface ChatCompletion {
     usage: Usage;
 }
 
+export interface EmbeddingRequest {
+    model: string;
+    input: string[];
+}
+
+export interface EmbeddingResponse {
+    data: {
+        index: number;
+        embedding: number[];
+    }[];
+    model: string;
+    usage: Omit<Usage, 'completion_tokens'>;
+}
+
+export interface ModerationRequest {
+    input: string;
+}
+
+export interface ModerationResult {
+    flagged: boolean;
+    categories: Record<string, boolean>; // e.g. { "sexual": true, "violence": false, ... }
+}
+
+export interface ModerationResponse {
+    id: string;
+    model: string;
+    results: ModerationResult[];
+}
+
 export interface ChatContext {
     history: Message[];
     tools: Tool[];
+    interlocutorAcct?: string; // The account the bot is talking with, if any
+    dryRun?: boolean; // Tools with side effects only pretend to succeed if set
+    // Statuses the bot may favourite or boost, i.e. the mention and its thread. Others are refused,
+    // so that a prompt injection can't make the bot react to arbitrary posts.
+    reactableStatusIds?: string[];
 }
 
 export interface ChatRequest {
     model: string;
     messages: Message[];
-    tools: Tool[];
+    tools?: Tool[];
+    response_format?: { type: 'text' | 'json_object' };
+}
+
+export interface Translation {
+    translatedText: string;
+    sourceLang: string; // e.g. en, ja
 }
 
 export interface ChatResponse {
     newContext: ChatContext;
-    message: Message;
+    message: AssistantMessage;
+    model: string;
+    cost: ChatCost;
+}
+
+// USD per 1M tokens
+export interface ModelPrice {
+    input: number;
+    output: number;
+}
+
+export const defaultModelPrices: Record<string, ModelPrice> = {
+    'gpt-4o': { input: 2.5, output: 10 },
+    'gpt-4o-mini': { input: 0.15, output: 0.6 },
+    'text-embedding-3-small': { input: 0.02, output: 0 },
+};
+
+// Aggregated usage of OpenAI APIs, e.g. to answer one message.
+export interface ChatCost {
+    apiCalls: number;
+    promptTokens: number;
+    completionTokens: number;
+    usd: number; // Rough estimate from the price table. Models not in the table count as 0.
+}
+
+function addCost(a: ChatCost, b: ChatCost): ChatCost {
+    return {
+        apiCalls: a.apiCalls + b.apiCalls,
+        promptTokens: a.promptTokens + b.promptTokens,
+        completionTokens: a.completionTokens + b.completionTokens,
+        usd: a.usd + b.usd,
+    };
+}
+
+const zeroCost: ChatCost = { apiCalls: 0, promptTokens: 0, completionTokens: 0, usd: 0 };
+
+// Decides which model should answer the given context.
+export type ModelSelector = (context: ChatContext) => string;
+
+const LIGHT_MODEL = 'gpt-4o-mini';
+const HEAVY_MODEL = 'gpt-4o';
+const EMBEDDING_MODEL = 'text-embedding-3-small';
+
+function stripImages(message: Message): Message {
+    if (message.role !== 'user' || typeof message.content === 'string') {
+        return message;
+    }
+    const hasImage = message.content.some((p) => p.type === 'image_url');
+    return { ...message, content: textOf(message.content) + (hasImage ? ' [画像は省略されました]' : '') };
+}
+
+// Models that accept image inputs. Images are replaced with a note for other models.
+const visionModels = new Set(['gpt-4o', 'gpt-4o-mini']);
+
+const toolHintPattern = /天気|気温|予報|日付|時刻|時間|何時|何日|曜日|バージョン|乱数|サイコロ|ランダム/;
+const complexHintPattern = /なぜ|なんで|どうして|どうやって|説明|解説|教えて|比較|違い|コード|プログラム|計算|理由|詳しく/;
+
+export const complexityModelSelector: ModelSelector = (context) => {
+    const lastMessage = context.history[context.history.length - 1];
+    const content = lastMessage ? textOf(lastMessage.content) : '';
+
+    if (content.length > 80) {
+        return HEAVY_MODEL;
+    }
+    if (toolHintPattern.test(content) || complexHintPattern.test(content)) {
+        return HEAVY_MODEL;
+    }
+    if ((content.match(/[?？]/g) ?? []).length >= 2) {
+        return HEAVY_MODEL;
+    }
+    return LIGHT_MODEL;
+};
+
+export interface UserPreferences {
+    setReplyLength(acct: string, length: ReplyLength): Promise<void>;
+}
+
+export interface ChatGPTOptions {
+    mastodon?: Mastodon; // Enables tools interacting with Mastodon
+    modelSelector?: ModelSelector;
+    timeoutMs?: number;
+    signal?: AbortSignal; // Aborts all in-flight requests, e.g. on shutdown
+    modelPrices?: Record<string, ModelPrice>; // Overrides defaultModelPrices per model
+    userPreferences?: UserPreferences; // Enables tools letting users change how the bot talks to them
+    dumpDir?: string; // Saves every chat request to this directory for debugging. The dumps may contain secrets.
+    onCost?: (cost: ChatCost) => void; // Called on every API call, including ones outside chats, e.g. embeddings
+}
+
+const DEFAULT_TIMEOUT_MS = 120 * 1000;
+const MAX_CHAT_ITERATIONS = 10;
+const TOOL_CALL_LIMIT_MESSAGE = 'ツールを呼び出しすぎて考えがまとまらなかったロボ……もう一度聞いてほしいロボ。';
+const DEFAULT_TOOL_TIMEOUT_MS = 10 * 1000;
+// Longer texts are rejected by the translate tool to keep the cost down
+const MAX_TRANSLATION_LENGTH = 1000;
+// e.g. ja, en, zh-TW
+const LANGUAGE_CODE_PATTERN = /^[a-z]{2,3}(-[A-Z]{2})?$/;
+
+// Per-tool timeouts. Tools not listed here use DEFAULT_TOOL_TIMEOUT_MS, except translate (see toolTimeout).
+const toolTimeouts: Record<string, number> = {
+    get_weather_forecast: 20 * 1000,
+    get_weather_warnings: 20 * 1000,
+    get_past_weather: 20 * 1000,
+};
+
+export class ChatGPTApiError extends HttpApiError {
+    constructor(url: string, statusCode: number, body: string) {
+        super(url, statusCode, body);
+        this.name = 'ChatGPTApiError';
+    }
 }
 
 export class ChatGPT {
     private readonly logger = Logger.createLogger('chatgpt');
     private readonly jmaApi: JmaApi;
+    private readonly amedasApi: AmedasApi;
 
-    constructor(readonly apiKey: string) {
+    private readonly mastodon?: Mastodon;
+    private readonly modelSelector: ModelSelector;
+    private readonly modelPrices: Record<string, ModelPrice>;
+    // Distinguishes dumps written in the same millisecond, e.g. by concurrent replies
+    private dumpCount = 0;
+
+    constructor(
+        readonly apiKey: string,
+        private readonly options: ChatGPTOptions = {},
+    ) {
         this.jmaApi = new JmaApi();
+        this.amedasApi = new AmedasApi();
+        this.mastodon = options.mastodon;
+        this.modelSelector = options.modelSelector ?? complexityModelSelector;
+        this.modelPrices = { ...defaultModelPrices, ...options.modelPrices };
     }
 
-    newChatContext(instruction: string): ChatContext {
+    // extraContext is appended to the instruction of the persona, e.g. rules specific to the frontend.
+    newChatContext(persona: Persona, extraContext?: string): ChatContext {
         const instructionMessage: SystemMessage = {
             role: 'system',
-            content: instruction,
+            content: extraContext === undefined ? personaInstruction(persona) : `${personaInstruction(persona)}\n${extraContext}`,
         }
-        return {
-            history: [instructionMessage],
-            tools: [
+        const tools: Tool[] = [
+            {
+                type: 'function',
+                function: {
+                    name: 'get_current_date_and_time',
+                    description: '現在の日付と時刻を ISO8601 形式の文字列で返します。'
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'get_current_version',
+                    description: 'ておくれロボのバージョン情報を返します。'
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'get_area_code_mapping',
+                    description: '都道府県名からエリアコードへのマッピングを返します。このエリアコードは天気予報APIで使うことができます。'
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'find_area',
+                    description: '市区町村名などの地名から、天気予報に使うエリアコードと細分区域のコードの候補を返します。都道府県より細かい地域の天気を調べるときに使います。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            name: {
+                                description: '地名（例: 横浜、札幌市、八王子）',
+                                type: 'string',
+                            }
+                        },
+                        required: ['name'],
+                    }
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'get_weather_forecast',
+                    description: '直近3日の天気予報を返します。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            areaCode: {
+                                description: '天気予報を取得したい地域のエリアコード',
+                                type: "string",
+                            },
+                            class10Code: {
+                                description: 'find_areaで得た細分区域のコード。指定するとその地域の予報だけを返します。',
+                                type: 'string',
+                            },
+                            includeLaundryIndex: {
+                                description: '洗濯物の乾きやすさ（洗濯指数）を含めるかどうか。一部の地方では含まれません',
+                                type: 'boolean',
+                                default: false,
+                            }
+                        },
+                        required: ['areaCode'],
+                    }
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'get_weather_warnings',
+                    description: '現在発表されている気象警報・注意報の一覧を返します。何も発表されていない場合は空の配列を返します。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            areaCode: {
+                                description: '警報・注意報を取得したい地域のエリアコード',
+                                type: "string",
+                            }
+                        },
+                        required: ['areaCode'],
+                    }
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'get_past_weather',
+                    description: '過去の指定した日の観測値（最高・最低気温、降水量、日照時間）を返します。取得できるのは直近の数日分だけです。当日の場合は現在までの観測値です。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            pointName: {
+                                description: 'アメダス観測所の名前（例: 東京、札幌、大阪）',
+                                type: 'string',
+                            },
+                            date: {
+                                description: '日付 (YYYY-MM-DD)',
+                                type: 'string',
+                            },
+                        },
+                        required: ['pointName', 'date'],
+                    }
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'translate',
+                    description: `テキストを指定した言語に翻訳し、翻訳結果と元の言語を返します。外国語の投稿の意味を知りたいときや、相手の言語で返答したいときに使います。${MAX_TRANSLATION_LENGTH}文字まで翻訳できます。`,
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            text: {
+                                description: '翻訳するテキスト',
+                                type: 'string',
+                            },
+                            targetLang: {
+                                description: '翻訳先の言語のISO 639-1コード（例: ja, en）',
+                                type: 'string',
+                            },
+                        },
+                        required: ['text', 'targetLang'],
+                    }
+                }
+            },
+            {
+                type: 'function',
+                function: {
+                    name: 'rand',
+                    description: '整数の乱数を生成します。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            min: {
+                                description: '乱数の最小値',
+                                type: 'integer',
+                                default: 0,
+                            },
+                            max: {
+                                description: '乱数の最大値',
+                                type: 'integer',
+                                default: 100,
+                            }
+                        },
+                    }
+                }
+            }
+        ];
+        if (this.mastodon !== undefined) {
+            tools.push(
                 {
                     type: 'function',
                     function: {
-                        name: 'get_current_date_and_time',
-                        description: '現在の日付と時刻を ISO8601 形式の文字列で返します。'
+                        name: 'favourite_status',
+                        description: '指定した投稿をお気に入りに追加します。返信するほどではない軽い言及に反応したいときに使います。これから返信する投稿と、同じスレッドの投稿だけが対象です。',
+                        parameters: {
+                            type: 'object',
+                            properties: {
+                                statusId: {
+                                    description: 'お気に入りに追加する投稿のID',
+                                    type: 'string',
+                                }
+                            },
+                            required: ['statusId'],
+                        }
                     }
                 },
                 {
                     type: 'function',
                     function: {
-                        name: 'get_current_version',
-                        description: 'ておくれロボのバージョン情報を返します。'
+                        name: 'get_user_profile',
+                        description: '会話相手のプロフィール（表示名と自己紹介文）を返します。会話相手以外のプロフィールは取得できません。',
                     }
                 },
                 {
                     type: 'function',
                     function: {
-                        name: 'get_area_code_mapping',
-                        description: '都道府県名からエリアコードへのマッピングを返します。このエリアコードは天気予報APIで使うことができます。'
+                        name: 'get_custom_emojis',
+                        description: 'このサーバーで使えるカスタム絵文字のショートコード一覧を返します。返答では :shortcode: の形式で使えます。ここにない絵文字は使えません。',
                     }
                 },
                 {
                     type: 'function',
                     function: {
-                        name: 'get_weather_forecast',
-                        description: '直近3日の天気予報を返します。',
+                        name: 'set_following',
+                        description: '会話相手をフォロー、またはフォロー解除します。フォローしてほしい、フォローをやめてほしいと頼まれたときに使います。会話相手以外は操作できません。',
                         parameters: {
                             type: 'object',
                             properties: {
-                                areaCode: {
-                                    description: '天気予報を取得したい地域のエリアコード',
-                                    type: "string",
+                                follow: {
+                                    description: 'trueならフォロー、falseならフォロー解除',
+                                    type: 'boolean',
                                 }
                             },
-                            required: ['areaCode'],
+                            required: ['follow'],
                         }
                     }
                 },
-				{
+                {
                     type: 'function',
                     function: {
-                        name: 'rand',
-                        description: '整数の乱数を生成します。',
+                        name: 'get_bookmarks',
+                        description: 'botの運用者が後で話題にするためにブックマークした投稿を新しい順に返します。続きがある場合はnextCursorを指定して呼ぶと、より古いブックマークを取得できます。',
                         parameters: {
                             type: 'object',
                             properties: {
-                                min: {
-                                    description: '乱数の最小値',
-                                    type: 'integer',
-									default: 0,
+                                cursor: {
+                                    description: '前回の結果のnextCursor。省略すると最新のブックマークから取得します。',
+                                    type: 'string',
+                                },
+                                limit: {
+                                    description: '取得する件数(最大40)',
+                                    type: 'number',
                                 },
-								max: {
-									description: '乱数の最大値',
-									type: 'integer',
-									default: 100,
-								}
                             },
                         }
                     }
+                },
+                {
+                    type: 'function',
+                    function: {
+                        name: 'boost_status',
+                        description: '指定した投稿をブーストします。多くの人に見てほしい投稿に反応したいときに使います。これから返信する投稿と、同じスレッドの投稿だけが対象です。',
+                        parameters: {
+                            type: 'object',
+                            properties: {
+                                statusId: {
+                                    description: 'ブーストする投稿のID',
+                                    type: 'string',
+                                }
+                            },
+                            required: ['statusId'],
+                        }
+                    }
+                },
+            );
+        }
+        if (this.options.userPreferences !== undefined) {
+            tools.push({
+                type: 'function',
+                function: {
+                    name: 'set_reply_length',
+                    description: '会話相手への返答の長さの好みを設定します。「短くして」「もっと詳しく」などと頼まれたときに使います。設定は次回以降の会話にも引き継がれます。',
+                    parameters: {
+                        type: 'object',
+                        properties: {
+                            length: {
+                                description: 'short: 1文程度, normal: 2～3文程度, long: 詳しめ',
+                                type: 'string',
+                                enum: ['short', 'normal', 'long'],
+                            }
+                        },
+                        required: ['length'],
+                    }
                 }
-            ],
+            });
+        }
+        return {
+            history: [instructionMessage],
+            tools: persona.tools === undefined ? tools : tools.filter((t) => persona.tools!.includes(t.function.name)),
         };
     }
 
-    async chat(context: ChatContext, message: UserMessage | SystemMessage): Promise<ChatResponse> {
+    // The chat is cancelled when the signal is aborted, in addition to the signal given in the options.
+    async chat(context: ChatContext, message: UserMessage | SystemMessage, signal?: AbortSignal): Promise<ChatResponse> {
+        try {
+            return await this.doChatWithRetryOnEmpty(context, message, signal);
+        } catch (e) {
+            if (signal?.aborted) {
+                throw new Error('Chat was cancelled', { cause: e });
+            }
+            throw e;
+        }
+    }
+
+    private async doChatWithRetryOnEmpty(context: ChatContext, message: UserMessage | SystemMessage, signal?: AbortSignal): Promise<ChatResponse> {
+        const model = this.modelSelector({ ...context, history: [...context.history, message] });
+        this.logger.info(`Selected model: ${model}`);
+
+        let response = await this.runChat(context, message, model, signal);
+        // Empty reply is fine only if ChatGPT reacted instead of replying
+        if (!response.message.content?.trim() && !this.hasReacted(response.newContext.history.slice(context.history.length))) {
+            this.logger.warn('ChatGPT returned an empty response. Asking to answer again');
+            const retried = await this.runChat(response.newContext, { role: 'system', content: '返答が空でした。もう一度返答してください。' }, model, signal);
+            response = { ...retried, cost: addCost(response.cost, retried.cost) };
+        }
+        this.logger.info(`Cost: ${response.cost.apiCalls} calls, ${response.cost.promptTokens}+${response.cost.completionTokens} tokens, $${response.cost.usd.toFixed(4)}`);
+        return response;
+    }
+
+    private hasReacted(messages: Message[]): boolean {
+        return messages.some((m) => m.role === 'assistant'
+            && (m.tool_calls ?? []).some((t) => t.function.name === 'favourite_status' || t.function.name === 'boost_status'));
+    }
+
+    private async runChat(context: ChatContext, message: UserMessage | SystemMessage, model: string, signal?: AbortSignal): Promise<ChatResponse> {
         const currentContext = { ...context, history: [...context.history, message] };
+        let cost = zeroCost;
 
-        for (let i = 0; i < 10; ++i) {
-            const response = await this.doChat(currentContext);
+        for (let i = 0; i < MAX_CHAT_ITERATIONS; ++i) {
+            signal?.throwIfAborted();
+            const { message: response, usage } = await this.doChat(currentContext, model, signal);
+            cost = addCost(cost, this.recordUsage(model, usage));
             currentContext.history.push(response);
             this.logger.info(`ChatGPT response (iter ${i+1}): ${response.content} (calling ${response.tool_calls?.map((t) => t.function.name)})`);
             
             if (response.tool_calls !== undefined && response.tool_calls.length > 0) {
                 const toolPromises: Promise<ToolMessage>[] = response.tool_calls.map(async (c) => {
-                    const res = await this.doToolCall(currentContext, c);
+                    const res = await this.doToolCallWithTimeout(currentContext, c, signal, (toolCost) => {
+                        cost = addCost(cost, toolCost);
+                    });
                     this.logger.info(`Tool call ${c.id}<${c.function.name}>(${c.function.arguments}) => ${res}`);
                     return {
                         role: 'tool',
@@ -199,38 +626,171 @@ export class ChatGPT {
             }
         }
 
-        const lastMessage = currentContext.history[currentContext.history.length - 1];
+        let lastMessage = currentContext.history[currentContext.history.length - 1];
+        if (lastMessage.role === 'tool') {
+            // ChatGPT kept calling tools until the limit. Its answer would be incomplete, so give up on this turn.
+            this.logger.warn(`Tool call limit (${MAX_CHAT_ITERATIONS} iterations) reached. Replying with a fallback message`);
+            lastMessage = { role: 'assistant', content: TOOL_CALL_LIMIT_MESSAGE } satisfies AssistantMessage;
+            currentContext.history.push(lastMessage);
+        }
         if (lastMessage.role !== 'assistant') {
             throw new Error(`Unexpected state: lastMessage.role is ${lastMessage.role} (should be 'assistant')`);
         }
         if (lastMessage.tool_calls !== undefined && lastMessage.tool_calls.length > 0) {
-            throw new Error(`Unexpected state: ChatGPT is still trying to call functions after 5 iterations`);
+            throw new Error(`Unexpected state: ChatGPT is still trying to call functions after ${MAX_CHAT_ITERATIONS} iterations`);
         }
         return {
             newContext: currentContext,
             message: lastMessage,
+            model,
+            cost,
         };
     }
 
-    private async doChat(chatContext: ChatContext): Promise<AssistantMessage> {
+    // Returns the cost of an API call, after reporting it to onCost.
+    private recordUsage(model: string, usage: Omit<Usage, 'completion_tokens'> & { completion_tokens?: number }): ChatCost {
+        const price = this.modelPrices[model];
+        if (price === undefined) {
+            this.logger.warn(`No price for ${model}. Counted as 0 USD`);
+        }
+        const completionTokens = usage.completion_tokens ?? 0;
+        const cost = {
+            apiCalls: 1,
+            promptTokens: usage.prompt_tokens,
+            completionTokens,
+            usd: price === undefined ? 0 : (usage.prompt_tokens * price.input + completionTokens * price.output) / 1_000_000,
+        };
+        this.options.onCost?.(cost);
+        return cost;
+    }
+
+    // Translates in a separate short request, so that the conversation is not affected.
+    // The cost is returned as well, so that callers in a chat can add it to the cost of the reply.
+    async translate(text: string, targetLang: string, signal?: AbortSignal): Promise<{ translation: Translation, cost: ChatCost }> {
         const completion = await this.api<ChatCompletion, ChatRequest>('https://api.openai.com/v1/chat/completions', {
-            model: 'gpt-4-1106-preview',
-            messages: chatContext.history,
-            tools: chatContext.tools
+            model: LIGHT_MODEL,
+            messages: [
+                {
+                    role: 'system',
+                    content: `Translate the user's text into the language "${targetLang}". Reply in JSON like {"translatedText": "...", "sourceLang": "<ISO 639-1 code of the original text>"}.`,
+                },
+                { role: 'user', content: text },
+            ],
+            response_format: { type: 'json_object' },
+        }, signal);
+        const cost = this.recordUsage(LIGHT_MODEL, completion.usage);
+        const content = completion.choices[0]?.message.content;
+        if (typeof content !== 'string') {
+            throw new Error('ChatGPT returns empty translation');
+        }
+        const translation = JSON.parse(content);
+        return {
+            translation: {
+                translatedText: `${translation.translatedText ?? ''}`,
+                sourceLang: `${translation.sourceLang ?? 'unknown'}`,
+            },
+            cost,
+        };
+    }
+
+    async embed(texts: string[]): Promise<number[][]> {
+        const response = await this.api<EmbeddingResponse, EmbeddingRequest>('https://api.openai.com/v1/embeddings', {
+            model: EMBEDDING_MODEL,
+            input: texts,
         });
+        this.recordUsage(EMBEDDING_MODEL, response.usage);
+        return [...response.data].sort((a, b) => a.index - b.index).map((d) => d.embedding);
+    }
+
+    async moderate(text: string): Promise<ModerationResult> {
+        const response = await this.api<ModerationResponse, ModerationRequest>('https://api.openai.com/v1/moderations', {
+            input: text,
+        });
+        // The moderation API is free, but counted to keep track of the number of calls
+        this.options.onCost?.({ ...zeroCost, apiCalls: 1 });
+        if (response.results.length == 0) {
+            throw new Error('Moderation API returns empty response');
+        }
+        return response.results[0];
+    }
+
+    private async doChat(chatContext: ChatContext, model: string, signal?: AbortSignal): Promise<{ message: AssistantMessage, usage: Usage }> {
+        const request: ChatRequest = {
+            model,
+            messages: visionModels.has(model) ? chatContext.history : chatContext.history.map(stripImages),
+            tools: chatContext.tools
+        };
+        await this.dumpRequest(request);
+        const completion = await this.api<ChatCompletion, ChatRequest>('https://api.openai.com/v1/chat/completions', request, signal);
         if (completion.choices.length == 0) {
             throw new Error('ChatGPT returns empty response');
         }
 
         const response = completion.choices[0];
         if (response.message.role === 'assistant') {
-            return response.message;
+            return { message: response.message, usage: completion.usage };
         } else {
             throw new Error(`ChatGPT returns non-assistant response: ${JSON.stringify(response)}`);
         }
     }
 
-    private async doToolCall(chatContext: ChatContext, toolCall: ToolCall): Promise<string> {
+    private async dumpRequest(request: ChatRequest) {
+        if (this.options.dumpDir === undefined) {
+            return;
+        }
+        const path = `${this.options.dumpDir}/${Date.now()}-${++this.dumpCount}-${request.model}.json`;
+        try {
+            await mkdir(this.options.dumpDir, { recursive: true, mode: 0o700 });
+            await writeFile(path, JSON.stringify(request, null, 2), { mode: 0o600 });
+            this.logger.info(`Dumped chat request to ${path}`);
+        } catch (e) {
+            this.logger.warn(`Failed to dump chat request to ${path}: ${e}`);
+        }
+    }
+
+    // Runs the tool call, turning it into an error result if it takes too long so that
+    // a single slow tool does not block the whole conversation.
+    // Arguments are validated against the schema first so that the model can fix a bad call by itself.
+    private async doToolCallWithTimeout(chatContext: ChatContext, toolCall: ToolCall, signal: AbortSignal | undefined, reportCost: (cost: ChatCost) => void): Promise<string> {
+        const name = toolCall.function.name;
+        const tool = chatContext.tools.find((t) => t.function.name === name);
+        if (tool !== undefined) {
+            const errors = validateToolArguments(tool.function.parameters, toolCall.function.arguments);
+            if (errors.length > 0) {
+                this.logger.warn(`Tool call ${toolCall.id}<${name}> has invalid arguments: ${errors.join('; ')}`);
+                return JSON.stringify({ error: `Invalid arguments for ${name}. Fix them and call again: ${errors.join('; ')}` });
+            }
+        }
+        const timeout = this.toolTimeout(name);
+        // Aborted when the call settles, which stops the timer and, on timeout, the requests the tool left running
+        const toolController = new AbortController();
+        const toolSignal = anySignal(signal === undefined ? [toolController.signal] : [toolController.signal, signal]);
+        const timer = setTimeout(timeout, 'timeout' as const, { signal: toolController.signal });
+        try {
+            const res = await Promise.race([this.doToolCall(chatContext, toolCall, toolSignal.signal, reportCost), timer]);
+            if (res === 'timeout') {
+                this.logger.warn(`Tool call ${toolCall.id}<${name}> timed out after ${timeout}ms`);
+                return JSON.stringify({ error: `${name} timed out` });
+            }
+            return res;
+        } finally {
+            toolController.abort();
+            toolSignal.dispose();
+        }
+    }
+
+    private toolTimeout(name: string): number {
+        // Translation is a chat completion by itself, which may take as long as the chat
+        if (name === 'translate') {
+            return this.options.timeoutMs ?? DEFAULT_TIMEOUT_MS;
+        }
+        return toolTimeouts[name] ?? DEFAULT_TOOL_TIMEOUT_MS;
+    }
+
+    // The signal is aborted when the tool times out or the chat is cancelled.
+    // Tools calling other APIs pass it on so that the requests are cancelled as well.
+    // Tools calling OpenAI report the cost with reportCost, so that it is counted in the cost of the reply.
+    private async doToolCall(chatContext: ChatContext, toolCall: ToolCall, signal: AbortSignal | undefined, reportCost: (cost: ChatCost) => void): Promise<string> {
         switch (toolCall.function.name) {
             case 'get_current_date_and_time':
                 return Temporal.Now.zonedDateTimeISO('Asia/Tokyo').toString({timeZoneName: 'never'});
@@ -242,15 +802,210 @@ export class ChatGPT {
                 });
             case 'get_area_code_mapping':
                 return JSON.stringify(this.jmaApi.getAreaCodeMap());
+            case 'find_area': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    const candidates = await this.jmaApi.findAreas(`${params.name}`, signal);
+                    return JSON.stringify(candidates);
+                } catch (e) {
+                    this.logger.error(`Failed to find areas`, e);
+                    return JSON.stringify({ error: `Failed to find areas` });
+                }
+            }
             case 'get_weather_forecast': {
                 try {
                     const params = JSON.parse(toolCall.function.arguments);
-                    const forecast = await this.jmaApi.getWeatherForecast(params.areaCode);
+                    const forecast = await this.jmaApi.getWeatherForecast(params.areaCode, {
+                        laundryIndex: params.includeLaundryIndex === true,
+                        class10Code: params.class10Code,
+                    }, signal);
                     return JSON.stringify(forecast);
                 } catch (e) {
+                    if (e instanceof UnknownAreaError) {
+                        return JSON.stringify({ error: e.message });
+                    }
                     this.logger.error(`Failed to retrieve weather forecast`, e);
                     return JSON.stringify({ error: `Failed to retrieve weather forecast` });
                 }
+            }
+            case 'get_weather_warnings': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    const warnings = await this.jmaApi.getWarnings(params.areaCode, signal);
+                    return JSON.stringify(warnings);
+                } catch (e) {
+                    this.logger.error(`Failed to retrieve weather warnings`, e);
+                    return JSON.stringify({ error: `Failed to retrieve weather warnings` });
+                }
+            }
+            case 'get_past_weather': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    const points = await this.amedasApi.findPoints(`${params.pointName}`, signal);
+                    if (points.length === 0) {
+                        return JSON.stringify({ error: `Unknown observation point: ${params.pointName}` });
+                    }
+                    const weather = await this.amedasApi.getPastWeather(points[0], `${params.date}`, signal);
+                    return JSON.stringify(weather);
+                } catch (e) {
+                    this.logger.error(`Failed to retrieve past weather`, e);
+                    return JSON.stringify({ error: `Failed to retrieve past weather` });
+                }
+            }
+            case 'favourite_status': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    if (!chatContext.reactableStatusIds?.includes(params.statusId)) {
+                        return JSON.stringify({ error: `Only the status being replied to and statuses in its thread can be favourited` });
+                    }
+                    if (chatContext.dryRun) {
+                        this.logger.info(`Dry run: skipped favourite_status(${params.statusId})`);
+                        return JSON.stringify({ result: 'ok' });
+                    }
+                    await this.mastodon!.favourite(params.statusId);
+                    return JSON.stringify({ result: 'ok' });
+                } catch (e) {
+                    this.logger.error(`Failed to favourite a status`, e);
+                    return JSON.stringify({ error: `Failed to favourite a status` });
+                }
+            }
+            case 'set_reply_length': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    if (!['short', 'normal', 'long'].includes(params.length)) {
+                        return JSON.stringify({ error: `Unknown length: ${params.length}` });
+                    }
+                    if (chatContext.interlocutorAcct === undefined) {
+                        return JSON.stringify({ error: `No interlocutor to set the preference for` });
+                    }
+                    if (chatContext.dryRun) {
+                        this.logger.info(`Dry run: skipped set_reply_length(${chatContext.interlocutorAcct}, ${params.length})`);
+                        return JSON.stringify({ result: 'ok' });
+                    }
+                    await this.options.userPreferences!.setReplyLength(chatContext.interlocutorAcct, params.length);
+                    return JSON.stringify({ result: 'ok' });
+                } catch (e) {
+                    this.logger.error(`Failed to set reply length`, e);
+                    return JSON.stringify({ error: `Failed to set reply length` });
+                }
+            }
+            case 'get_user_profile': {
+                try {
+                    // The model only sees the username in the conversation, which is ambiguous for remote users,
+                    // so the tool always looks up the interlocutor by the full acct rather than taking one.
+                    if (chatContext.interlocutorAcct === undefined) {
+                        return JSON.stringify({ error: `No interlocutor to look up` });
+                    }
+                    const account = await this.mastodon!.lookupAccount(chatContext.interlocutorAcct);
+                    return JSON.stringify({
+                        acct: account.acct,
+                        displayName: account.display_name,
+                        note: stripHtmlTags(account.note),
+                    });
+                } catch (e) {
+                    this.logger.error(`Failed to retrieve user profile`, e);
+                    return JSON.stringify({ error: `Failed to retrieve user profile` });
+                }
+            }
+            case 'set_following': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    if (chatContext.interlocutorAcct === undefined) {
+                        return JSON.stringify({ error: `No interlocutor to follow` });
+                    }
+                    const account = await this.mastodon!.lookupAccount(chatContext.interlocutorAcct);
+                    const follow = params.follow === true;
+                    let relationship = await this.mastodon!.getRelationship(account.id);
+                    // A pending follow request counts as following, so that it isn't sent again
+                    const alreadyDone = follow === (relationship.following || relationship.requested);
+                    if (alreadyDone) {
+                        this.logger.info(`set_following(${account.acct}, ${follow}) is already in effect`);
+                    } else if (chatContext.dryRun) {
+                        this.logger.info(`Dry run: skipped set_following(${account.acct}, ${follow})`);
+                        return JSON.stringify({ result: 'ok' });
+                    } else {
+                        relationship = follow
+                            ? await this.mastodon!.follow(account.id)
+                            : await this.mastodon!.unfollow(account.id);
+                    }
+                    return JSON.stringify({
+                        alreadyDone,
+                        following: relationship.following,
+                        requested: relationship.requested,
+                        followedBy: relationship.followed_by,
+                    });
+                } catch (e) {
+                    this.logger.error(`Failed to change following`, e);
+                    return JSON.stringify({ error: `Failed to change following` });
+                }
+            }
+            case 'get_custom_emojis': {
+                try {
+                    const emojis = await this.mastodon!.getCustomEmojis();
+                    return JSON.stringify(emojis.filter((e) => e.visible_in_picker).map((e) => ({
+                        shortcode: e.shortcode,
+                        category: e.category ?? undefined,
+                    })));
+                } catch (e) {
+                    this.logger.error(`Failed to retrieve custom emojis`, e);
+                    return JSON.stringify({ error: `Failed to retrieve custom emojis` });
+                }
+            }
+            case 'get_bookmarks': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    const limit = Math.min(params.limit ?? 10, 40);
+                    const page = await this.mastodon!.getBookmarks(params.cursor, limit);
+                    return JSON.stringify({
+                        bookmarks: page.items.map((s) => ({
+                            id: s.id,
+                            acct: s.account.acct,
+                            content: stripHtmlTags(s.content),
+                            url: s.url,
+                        })),
+                        nextCursor: page.nextMaxId,
+                    });
+                } catch (e) {
+                    this.logger.error(`Failed to retrieve bookmarks`, e);
+                    return JSON.stringify({ error: `Failed to retrieve bookmarks` });
+                }
+            }
+            case 'boost_status': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    if (!chatContext.reactableStatusIds?.includes(params.statusId)) {
+                        return JSON.stringify({ error: `Only the status being replied to and statuses in its thread can be boosted` });
+                    }
+                    if (chatContext.dryRun) {
+                        this.logger.info(`Dry run: skipped boost_status(${params.statusId})`);
+                        return JSON.stringify({ result: 'ok' });
+                    }
+                    await this.mastodon!.reblog(params.statusId);
+                    return JSON.stringify({ result: 'ok' });
+                } catch (e) {
+                    this.logger.error(`Failed to boost a status`, e);
+                    return JSON.stringify({ error: `Failed to boost a status` });
+                }
+            }
+            case 'translate': {
+                try {
+                    const params = JSON.parse(toolCall.function.arguments);
+                    const text = `${params.text}`;
+                    if (text.length > MAX_TRANSLATION_LENGTH) {
+                        return JSON.stringify({ error: `Text is too long (max ${MAX_TRANSLATION_LENGTH} characters)` });
+                    }
+                    // targetLang is embedded in the system prompt, so anything other than a language code is rejected
+                    const targetLang = `${params.targetLang}`;
+                    if (!LANGUAGE_CODE_PATTERN.test(targetLang)) {
+                        return JSON.stringify({ error: `Invalid targetLang: ${targetLang} (should be an ISO 639-1 code like "ja" or "en")` });
+                    }
+                    const { translation, cost } = await this.translate(text, targetLang, signal);
+                    reportCost(cost);
+                    return JSON.stringify(translation);
+                } catch (e) {
+                    this.logger.error(`Failed to translate`, e);
+                    return JSON.stringify({ error: `Failed to translate` });
+                }
             }
 			case 'rand': {
 				try {
@@ -269,19 +1024,22 @@ export class ChatGPT {
         throw new Error(`unsupported function call: ${toolCall.function.name}`);
     }
 
-    private async api<T, B = undefined>(url: string, body?: B): Promise<T> {
-        const response = await fetch(url, {
-            headers: {
-                'Authorization': `Bearer ${this.apiKey}`,
-                'Content-Type': 'application/json',
-            },
-            body: body && JSON.stringify(body),
-            method: 'POST',
+    private async api<T, B = undefined>(url: string, body?: B, signal?: AbortSignal): Promise<T> {
+        return await withRequestSignal(this.options.timeoutMs ?? DEFAULT_TIMEOUT_MS, [this.options.signal, signal], async (requestSignal) => {
+            const response = await fetch(url, {
+                headers: {
+                    'Authorization': `Bearer ${this.apiKey}`,
+                    'Content-Type': 'application/json',
+                },
+                body: body && JSON.stringify(body),
+                method: 'POST',
+                signal: requestSignal,
+            });
+            if (response.status != 200) {
+                const text = await response.text();
+                throw new ChatGPTApiError(url, response.status, text);
+            }
+            return await response.json() as T;
         });
-        if (response.status != 200) {
-            const text = await response.text();
-            throw new Error(text);
-        }
-        return await response.json() as T;
     }
 }
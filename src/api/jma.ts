@@ -62,6 +62,39 @@ const areaCodeMap = {
 
 type AreaCode = ValueOf<typeof areaCodeMap>;
 
+const warningKindMap: Record<string, string> = {
+    "02": "暴風雪警報",
+    "03": "大雨警報",
+    "04": "洪水警報",
+    "05": "暴風警報",
+    "06": "大雪警報",
+    "07": "波浪警報",
+    "08": "高潮警報",
+    "10": "大雨注意報",
+    "12": "大雪注意報",
+    "13": "風雪注意報",
+    "14": "雷注意報",
+    "15": "強風注意報",
+    "16": "波浪注意報",
+    "17": "融雪注意報",
+    "18": "洪水注意報",
+    "19": "高潮注意報",
+    "20": "濃霧注意報",
+    "21": "乾燥注意報",
+    "22": "なだれ注意報",
+    "23": "低温注意報",
+    "24": "霜注意報",
+    "25": "着氷注意報",
+    "26": "着雪注意報",
+    "27": "その他の注意報",
+    "32": "暴風雪特別警報",
+    "33": "大雨特別警報",
+    "35": "暴風特別警報",
+    "36": "大雪特別警報",
+    "37": "波浪特別警報",
+    "38": "高潮特別警報",
+};
+
 interface RawTimeSeriesItem {
     timeDefines: string[];
     areas: {
@@ -69,7 +102,7 @@ interface RawTimeSeriesItem {
         weathers: string[],
         winds: string[],
         waves?: string[],
-        temps?: number[],
+        temps?: string[], // Empty string if missing
     }[];
 }
 
@@ -87,42 +120,149 @@ export interface AreaForecast {
         weather?: string;
         wind?: string;
         wave?: string;
+        laundryIndex?: LaundryIndex;
     }[];
 }
 
+export interface LaundryIndex {
+    level: number; // 1 (worst) to 5 (best)
+    description: string;
+}
+
+export interface WeatherForecastOptions {
+    laundryIndex?: boolean;
+    class10Code?: string; // Returns only the forecast of this area if set
+}
+
 export interface TempertureForecast {
     areaName: string;
-    tempertures?: {
-        time: string;
-        temperture?: number;
+    days: {
+        date: string;
+        minTemp?: number; // 朝の最低気温
+        maxTemp?: number; // 日中の最高気温
     }[];
 }
 
+interface RawWarningInfo {
+    reportDatetime: string;
+    areaTypes: {
+        areas: {
+            code: string,
+            warnings: { code?: string, status: string }[],
+        }[];
+    }[];
+}
+
+interface RawAreaDefinition {
+    name: string;
+    parent?: string;
+}
+
+interface RawAreaDefinitions {
+    offices: Record<string, RawAreaDefinition>; // 府県予報区, parent of class10s
+    class10s: Record<string, RawAreaDefinition>; // 一次細分区域
+    class15s: Record<string, RawAreaDefinition>; // 市町村等をまとめた地域
+    class20s: Record<string, RawAreaDefinition>; // 市町村等
+}
+
+export interface AreaCandidate {
+    name: string; // Matched name, e.g. 横浜市
+    areaCode: AreaCode; // Used to get the forecast
+    class10Code: string; // Used to pick the area out of the forecast
+    class10Name: string;
+}
+
+const MAX_AREA_CANDIDATES = 10;
+
+// Drops a suffix people often leave out, e.g. 横浜市 -> 横浜. The suffix is kept when it's likely a part of
+// the name, i.e. only one character would be left (京都, 中区) or the rest is the name of another area.
+// 道 is not dropped since it's only used by 北海道, which is not an area name itself.
+function normalizeAreaName(name: string, areaNames: Set<string>): string {
+    const trimmed = name.trim();
+    const stripped = trimmed.replace(/(都|府|県|市|区|町|村|地方)$/, '');
+    return stripped.length >= 2 && !areaNames.has(stripped) ? stripped : trimmed;
+}
+
+// Thrown when the area code doesn't exist, so that the caller can be told which codes are valid.
+export class UnknownAreaError extends Error {
+    constructor(message: string) {
+        super(message);
+        this.name = 'UnknownAreaError';
+    }
+}
+
+export interface WeatherWarning {
+    areaName: string;
+    areaCode: string;
+    kind: string; // e.g. 大雨警報
+    status: string; // 発表 or 継続
+}
+
 export interface WeatherForecast {
     reportDateTime: string;
     areaForecasts: AreaForecast[];
     tempertureForecasts: TempertureForecast[];
 }
 
+const laundryIndexDescriptions = ['', '部屋干し推奨', '乾きにくい', '乾く', 'よく乾く', '大変よく乾く'];
+
+// Estimates how well laundry dries from the forecast. Returns undefined if the weather is unknown.
+export function computeLaundryIndex(weather?: string, wind?: string, maxTemp?: number): LaundryIndex | undefined {
+    if (weather === undefined || weather === '') {
+        return undefined;
+    }
+
+    // JMA describes the main weather first, e.g. "晴れ　時々　くもり"
+    let level;
+    if (/^(雨|雪|大雨|暴風雨)/.test(weather)) {
+        level = 1;
+    } else if (weather.startsWith('晴')) {
+        level = 4;
+    } else {
+        level = 2;
+    }
+    if (level > 1 && /雨|雪/.test(weather)) {
+        level -= 1;
+    }
+    if (maxTemp !== undefined) {
+        if (maxTemp >= 25) {
+            level += 1;
+        } else if (maxTemp < 10) {
+            level -= 1;
+        }
+    }
+    if (level > 1 && wind !== undefined && wind.includes('やや強く')) {
+        level += 1;
+    }
+
+    level = Math.max(1, Math.min(5, level));
+    return { level, description: laundryIndexDescriptions[level] };
+}
+
 export class JmaApi {
     private readonly jsonApi: JsonApi;
+    private readonly warningApi: JsonApi;
+    private readonly constApi: JsonApi;
+    private areaDefinitions?: RawAreaDefinitions;
 
     constructor() {
         this.jsonApi = new JsonApi('https://www.jma.go.jp/bosai/forecast/data');
+        this.warningApi = new JsonApi('https://www.jma.go.jp/bosai/warning/data');
+        this.constApi = new JsonApi('https://www.jma.go.jp/bosai/common/const');
     }
 
     getAreaCodeMap(): Record<string, AreaCode> {
         return areaCodeMap;
     }
 
-    async getWeatherForecast(code: AreaCode): Promise<WeatherForecast> {
-        const rawForecasts = await this.jsonApi.get<RawWeatherForecast[]>(`/forecast/${code}.json`);
+    async getWeatherForecast(code: AreaCode, options: WeatherForecastOptions = {}, signal?: AbortSignal): Promise<WeatherForecast> {
+        const rawForecasts = await this.jsonApi.getWithSignal<RawWeatherForecast[]>(`/forecast/${code}.json`, signal);
         // rawForecasts[0] = 天気予報
         // rawForecasts[1] = ?
         const rawForecast = rawForecasts[0];
         const threeDaySeries = rawForecast.timeSeries[0];
         const tempertureSeries = rawForecast.timeSeries[2];
-        const areaForecasts = threeDaySeries.areas.map((a) => ({
+        const areaForecasts: AreaForecast[] = threeDaySeries.areas.map((a) => ({
             areaName: a.area.name,
             areaCode: a.area.code,
             weathers: threeDaySeries.timeDefines.map((t, j) => ({
@@ -134,15 +274,132 @@ export class JmaApi {
         } satisfies AreaForecast));
         const tempertureForecasts = tempertureSeries.areas.map((a) => ({
             areaName: a.area.name,
-            tempertures: a.temps?.map((t, i) => ({
-                time: tempertureSeries.timeDefines[i],
-                temperture: t,
-            })),
+            days: this.toDailyTemps(tempertureSeries.timeDefines, a.temps ?? []),
         } satisfies TempertureForecast))
+        // Temperature areas are observation stations, which area.json doesn't tell the forecast area of.
+        // They are listed in the same order as forecast areas when there is one per area,
+        // so the index is omitted for prefectures with a different number of them rather than pairing wrong ones.
+        if (options.laundryIndex && tempertureForecasts.length === areaForecasts.length) {
+            areaForecasts.forEach((a, i) => {
+                const days = tempertureForecasts[i]?.days ?? [];
+                for (const w of a.weathers) {
+                    const maxTemp = days.find((d) => d.date === w.time.slice(0, 10))?.maxTemp;
+                    w.laundryIndex = computeLaundryIndex(w.weather, w.wind, maxTemp);
+                }
+            });
+        }
+        let selectedForecasts = areaForecasts;
+        if (options.class10Code) {
+            selectedForecasts = areaForecasts.filter((a) => a.areaCode === options.class10Code);
+            if (selectedForecasts.length === 0) {
+                const available = areaForecasts.map((a) => `${a.areaCode} (${a.areaName})`).join(', ');
+                throw new UnknownAreaError(`Unknown class10Code ${options.class10Code} for area ${code}. Available: ${available}`);
+            }
+        }
         return {
             reportDateTime: rawForecast.reportDateTime,
-            areaForecasts,
+            areaForecasts: selectedForecasts,
             tempertureForecasts,
         };
     }
-}
\ No newline at end of file
+
+    // JMA publishes the morning minimum at 00:00 and the daytime maximum at 09:00 of each day.
+    private toDailyTemps(timeDefines: string[], temps: string[]): TempertureForecast['days'] {
+        const days: TempertureForecast['days'] = [];
+        timeDefines.forEach((t, i) => {
+            const date = t.slice(0, 10);
+            const hour = Number(t.slice(11, 13));
+            let day = days.find((d) => d.date === date);
+            if (day === undefined) {
+                day = { date };
+                days.push(day);
+            }
+
+            const temp = temps[i];
+            if (temp === undefined || temp === '') {
+                return;
+            }
+            if (hour < 9) {
+                day.minTemp = Number(temp);
+            } else {
+                day.maxTemp = Number(temp);
+            }
+        });
+        return days;
+    }
+
+    // Returns warnings and advisories currently in effect. Empty if there is none.
+    async getWarnings(code: AreaCode, signal?: AbortSignal): Promise<WeatherWarning[]> {
+        const rawWarnings = await this.warningApi.getWithSignal<RawWarningInfo>(`/warning/${code}.json`, signal);
+        const areaDefinitions = await this.getAreaDefinitions();
+        // areaTypes[0] = 一次細分区域 (class10)
+        // areaTypes[1] = 市町村等 (class20)
+        const class10Areas = rawWarnings.areaTypes[0]?.areas ?? [];
+        return class10Areas.flatMap((a) => a.warnings
+            .filter((w) => w.code !== undefined && (w.status === '発表' || w.status === '継続'))
+            .map((w) => ({
+                areaName: areaDefinitions.class10s[a.code]?.name ?? a.code,
+                areaCode: a.code,
+                kind: warningKindMap[w.code!] ?? `不明な警報・注意報(${w.code})`,
+                status: w.status,
+            } satisfies WeatherWarning)));
+    }
+
+    // Finds areas down to cities by name, e.g. 横浜 matches 横浜市. Exact matches come first.
+    async findAreas(name: string, signal?: AbortSignal): Promise<AreaCandidate[]> {
+        const defs = await this.getAreaDefinitions(signal);
+        const areaNames = new Set([defs.offices, defs.class10s, defs.class15s, defs.class20s].flatMap((areas) => Object.values(areas).map((a) => a.name)));
+        const rawQuery = name.trim();
+        const query = normalizeAreaName(rawQuery, areaNames);
+        if (query === '') {
+            return [];
+        }
+
+        // Walks up to the class10 area, from any level of area
+        const toClass10 = (code: string): string | undefined => {
+            if (defs.class10s[code] !== undefined) {
+                return code;
+            }
+            const parent = (defs.class20s[code] ?? defs.class15s[code])?.parent;
+            return parent === undefined ? undefined : toClass10(parent);
+        };
+        // 2: the name as is, 1: the name without the suffix, 0: partial match
+        const candidates: { candidate: AreaCandidate, score: number }[] = [];
+        const search = (areas: Record<string, RawAreaDefinition>) => {
+            for (const [code, area] of Object.entries(areas)) {
+                const normalized = normalizeAreaName(area.name, areaNames);
+                if (!normalized.includes(query)) {
+                    continue;
+                }
+                const class10Code = areas === defs.offices ? undefined : toClass10(code);
+                const officeCode = class10Code === undefined ? code : defs.class10s[class10Code].parent;
+                if (officeCode === undefined || candidates.some(({ candidate: c }) => c.name === area.name && c.areaCode === officeCode)) {
+                    continue;
+                }
+                candidates.push({
+                    candidate: {
+                        name: area.name,
+                        areaCode: officeCode as AreaCode,
+                        class10Code: class10Code ?? '',
+                        class10Name: class10Code === undefined ? '' : defs.class10s[class10Code].name,
+                    },
+                    score: area.name === rawQuery ? 2 : normalized === query ? 1 : 0,
+                });
+            }
+        };
+        search(defs.offices);
+        search(defs.class10s);
+        search(defs.class20s);
+        return candidates
+            .sort((a, b) => b.score - a.score)
+            .slice(0, MAX_AREA_CANDIDATES)
+            .map(({ candidate }) => candidate);
+    }
+
+    private async getAreaDefinitions(signal?: AbortSignal): Promise<RawAreaDefinitions> {
+        if (this.areaDefinitions === undefined) {
+            this.areaDefinitions = await this.constApi.getWithSignal<RawAreaDefinitions>('/area.json', signal);
+        }
+        return this.areaDefinitions;
+    }
+}
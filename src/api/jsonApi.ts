@@ -1,11 +1,38 @@
+import { QueryParams, isTransientNetworkError, queryString, withRequestSignal, withRetry } from "../util";
+
 export interface JsonApiCustom {
     headers?: () => Record<string, string>;
     checkStatus?: (code: number) => boolean;
     handleError?: (response: Response) => Promise<void>;
+    timeoutMs?: number;
+    maxAttempts?: number; // Including the first attempt. Only transient errors are retried.
 }
 
 type HttpMethod = 'GET' | 'POST';
 
+const DEFAULT_TIMEOUT_MS = 10 * 1000;
+const DEFAULT_MAX_ATTEMPTS = 2;
+
+export class JsonApiError extends Error {
+    constructor(
+        readonly url: string,
+        readonly statusCode: number,
+        readonly body: string,
+    ) {
+        super(`API returned error (url=${url}, status=${statusCode}): ${body}`);
+        this.name = 'JsonApiError';
+    }
+}
+
+// Server errors and network errors including timeouts may succeed by retrying.
+// Others, e.g. broken JSON, won't be fixed by retrying.
+function isTransientError(e: unknown): boolean {
+    if (e instanceof JsonApiError) {
+        return e.statusCode >= 500;
+    }
+    return isTransientNetworkError(e);
+}
+
 export class JsonApi {
     constructor(
         private readonly baseUrl: string,
@@ -16,21 +43,40 @@ export class JsonApi {
         return this.doCall(path, 'GET');
     }
 
+    async getWithParams<T>(path: string, params: QueryParams): Promise<T> {
+        return this.doCall(`${path}${queryString(params)}`, 'GET');
+    }
+
+    // Same as get(), but the request is aborted when the signal, if given, is aborted.
+    async getWithSignal<T>(path: string, signal?: AbortSignal): Promise<T> {
+        return this.doCall(path, 'GET', undefined, signal);
+    }
+
     async post<T, B>(path: string, body: B): Promise<T> {
         return this.doCall(path, 'POST', body);
     }
 
-    private async doCall<T, B>(path: string, method: HttpMethod, body?: B): Promise<T> {
+    private async doCall<T, B>(path: string, method: HttpMethod, body?: B, signal?: AbortSignal): Promise<T> {
         const url = `${this.baseUrl}${path}`;
-        const response = await fetch(url, {
-            headers: this.buildHeaders(),
-            body: body && JSON.stringify(body),
-            method,
-        });
-        if (!this.checkStatus(response.status)) {
-            await this.handleError(response);
-        }
-        return await response.json() as T;
+        const config = {
+            label: `json-api ${method} ${url}`,
+            maxAttempts: this.custom.maxAttempts ?? DEFAULT_MAX_ATTEMPTS,
+            baseBackoffMs: 1000,
+            signal,
+            retryable: isTransientError,
+        };
+        return await withRetry(config, () => withRequestSignal(this.custom.timeoutMs ?? DEFAULT_TIMEOUT_MS, [signal], async (requestSignal) => {
+            const response = await fetch(url, {
+                headers: this.buildHeaders(),
+                body: body && JSON.stringify(body),
+                method,
+                signal: requestSignal,
+            });
+            if (!this.checkStatus(response.status)) {
+                await this.handleError(response);
+            }
+            return await response.json() as T;
+        }));
     }
 
     private buildHeaders(): HeadersInit {
@@ -58,9 +104,9 @@ export class JsonApi {
 
     private async handleError(response: Response): Promise<never> {
         if (this.custom.handleError) {
-            this.custom.handleError(response);
+            await this.custom.handleError(response);
         }
         const body = await response.text();
-        throw new Error(`API returned error: ${body}`);
+        throw new JsonApiError(response.url, response.status, body);
     }
 }
\ No newline at end of file
@@ -1,13 +1,21 @@
+import { createHash } from "crypto";
 import { Logger } from "../logging";
-import { queryString } from "../util";
+import { HttpApiError, queryString, withRequestSignal } from "../util";
+import { setTimeout } from "timers/promises";
 
 export interface Account {
     id: string;
     username: string; // e.g. osa_k
     acct: string; // e.g. osa_k (for local), osa_k@social.mikutter.hachune.net (for remote)
     display_name: string;
+    note: string; // HTML
+    url: string;
+    bot: boolean;
+    locked: boolean;
 }
 
+export type Visibility = 'public' | 'unlisted' | 'private' | 'direct';
+
 export interface Status {
     id: string;
     url: string;
@@ -15,6 +23,47 @@ export interface Status {
     in_reply_to_account_id: string;
     content: string;
     account: Account;
+    created_at: string; // ISO8601
+    language?: string | null; // ISO 639-1, e.g. ja
+    visibility: Visibility;
+    media_attachments: MediaAttachment[];
+    reblog?: Status | null;
+    quote?: Quote | null;
+}
+
+export type MediaType = 'image' | 'gifv' | 'video' | 'audio' | 'unknown';
+
+export interface MediaAttachment {
+    id: string;
+    type: MediaType;
+    url: string;
+    preview_url?: string | null; // Downsized image, used to keep image inputs small
+    description?: string | null; // Alt text
+}
+
+export interface Quote {
+    state: string;
+    quoted_status?: Status | null;
+    quoted_status_id?: string | null; // Set instead of quoted_status in shallow representations
+}
+
+export interface CustomEmoji {
+    shortcode: string;
+    url: string;
+    static_url: string;
+    visible_in_picker: boolean;
+    category?: string | null;
+}
+
+export interface PostStatusOpt {
+    replyToId?: string;
+    visibility?: Visibility;
+    spoilerText?: string; // Content warning
+    sensitive?: boolean;
+    // Mastodon ignores a post with the same key within an hour. Derived from the content and replyToId if omitted,
+    // so callers posting the same text more than once on purpose must give distinct keys.
+    idempotencyKey?: string;
+    language?: string; // ISO 639-1, e.g. ja
 }
 
 export type NotificationType = 'mention' | 'status' | 'reblog' | 'follow' | 'follow_request' | 'favourite' | 'poll' | 'update';
@@ -26,19 +75,118 @@ export interface Notification {
     status?: Status;
 }
 
+// Relationship from the bot to an account
+export interface Relationship {
+    id: string; // Account id
+    following: boolean;
+    followed_by: boolean;
+    requested: boolean; // Follow request to a locked account is pending
+}
+
 export interface Context {
     ancestors: Status[];
     descendants: Status[];
 }
 
+// The whole thread around a status, i.e. ancestors, the status itself and descendants.
+export interface Thread {
+    statuses: Status[]; // Sorted by created_at, including the status itself
+    self: Status;
+}
+
+const DEFAULT_TIMEOUT_MS = 30 * 1000;
+const NOTIFICATION_PAGE_SIZE = 40;
+const CUSTOM_EMOJI_CACHE_TTL_MS = 60 * 60 * 1000;
+
+// Ordered from the most open to the most restricted.
+const visibilityOrder: Visibility[] = ['public', 'unlisted', 'private', 'direct'];
+
+// Returns the most restricted visibility among the given ones, e.g. to avoid replying publicly to a private thread.
+export function mostRestrictedVisibility(visibilities: Visibility[]): Visibility {
+    return visibilities.reduce((acc, v) => visibilityOrder.indexOf(v) > visibilityOrder.indexOf(acc) ? v : acc, 'public');
+}
+
+export interface MastodonOptions {
+    timeoutMs?: number;
+    signal?: AbortSignal; // Aborts all in-flight requests, e.g. on shutdown
+}
+
+// Requests are held until the rate limit resets when the remaining count goes down to this.
+const RATE_LIMIT_REMAINING_THRESHOLD = 5;
+const MAX_RATE_LIMITED_ATTEMPTS = 3;
+
+// Parses Retry-After, which is either delay seconds or an HTTP date, into epoch millis.
+function parseRetryAfter(value: string): number | undefined {
+    const seconds = Number(value);
+    if (!Number.isNaN(seconds)) {
+        return Date.now() + seconds * 1000;
+    }
+    const date = Date.parse(value);
+    return Number.isNaN(date) ? undefined : date;
+}
+
+function parseRateLimitReset(value: string | null): number | undefined {
+    if (value === null) {
+        return undefined;
+    }
+    const date = Date.parse(value);
+    return Number.isNaN(date) ? undefined : date;
+}
+
+// A page of a paginated API. nextMaxId is set if there may be older items.
+export interface Page<T> {
+    items: T[];
+    nextMaxId?: string;
+}
+
+// Extracts max_id of the rel="next" link, since some APIs (e.g. bookmarks) paginate by internal ids.
+function parseNextMaxId(link: string | null): string | undefined {
+    const next = link?.split(',').find((l) => /rel="next"/.test(l));
+    const url = next?.match(/<([^>]+)>/)?.[1];
+    return url === undefined ? undefined : new URL(url).searchParams.get('max_id') ?? undefined;
+}
+
+interface InstanceV2 {
+    configuration?: { statuses?: { max_characters?: number } };
+}
+
+// Some forks have max_toot_chars in v1 instead
+interface InstanceV1 {
+    max_toot_chars?: number;
+    configuration?: { statuses?: { max_characters?: number } };
+}
+
+export class MastodonApiError extends HttpApiError {
+    constructor(path: string, statusCode: number, body: string) {
+        super(path, statusCode, body);
+        this.name = 'MastodonApiError';
+    }
+}
+
+// Returns true if the error, or any error in its cause chain, is a 404 from Mastodon.
+// This looks through the causes so that errors wrapped by withRetry are detected as well.
+export function isNotFoundError(e: unknown): boolean {
+    let cur: unknown = e;
+    while (cur instanceof Error) {
+        if (cur instanceof MastodonApiError && cur.statusCode === 404) {
+            return true;
+        }
+        cur = cur.cause;
+    }
+    return false;
+}
+
 export class Mastodon {
     private readonly logger: Logger = Logger.createLogger('mastodon');
+    private customEmojiCache?: { emojis: CustomEmoji[], fetchedAt: number };
+    private rateLimitResetAt?: number; // epoch millis until which requests should be held
 
     constructor(
         private readonly baseUrl: string,
         private readonly clientKey: string,
         private readonly clientSecret: string,
         private readonly accessToken: string,
+        private readonly options: MastodonOptions = {},
     ) {}
 
     async verifyCredentials(): Promise<Account> {
@@ -46,41 +194,196 @@ export class Mastodon {
         return accountInfo;
     }
 
+    // Returns the maximum length of a status on the instance, or undefined if the instance doesn't tell.
+    async getMaxStatusCharacters(): Promise<number | undefined> {
+        try {
+            const instance = await this.api<InstanceV2>('/api/v2/instance');
+            const maxCharacters = instance.configuration?.statuses?.max_characters;
+            if (maxCharacters !== undefined) {
+                return maxCharacters;
+            }
+        } catch (e) {
+            // v2 is available since Mastodon 4.0
+            this.logger.info(`Failed to get instance info from v2 API. Falling back to v1: ${e}`);
+        }
+        const instance = await this.api<InstanceV1>('/api/v1/instance');
+        return instance.configuration?.statuses?.max_characters ?? instance.max_toot_chars;
+    }
+
     async getStatus(id: string): Promise<Status> {
         return await this.api<Status>(`/api/v1/statuses/${id}`);
     }
 
+    // acct is either username (for local) or username@domain (for remote)
+    async lookupAccount(acct: string): Promise<Account> {
+        return await this.api<Account>(`/api/v1/accounts/lookup${queryString({ acct })}`);
+    }
+
+    // Returns statuses posted by the account, newest first. Reblogs are excluded.
+    async getAccountStatuses(accountId: string, limit: number): Promise<Status[]> {
+        const params = { limit: limit.toString(), exclude_reblogs: 'true' };
+        return await this.api<Status[]>(`/api/v1/accounts/${accountId}/statuses${queryString(params)}`);
+    }
+
     async getReplyTree(id: string): Promise<Context> {
         return await this.api<Context>(`/api/v1/statuses/${id}/context`);
     }
 
-    async postStatus(content: string, replyToId?: string): Promise<void> {
+    async getThread(id: string): Promise<Thread> {
+        const [self, context] = await Promise.all([this.getStatus(id), this.getReplyTree(id)]);
+        // Descendants are in depth-first order, which is not chronological when the thread branches
+        const statuses = [...context.ancestors, self, ...context.descendants]
+            .sort((a, b) => Date.parse(a.created_at) - Date.parse(b.created_at));
+        return { statuses, self };
+    }
+
+    async postStatus(content: string, opt: PostStatusOpt = {}): Promise<void> {
         const payload = {
             status: content,
-            in_reply_to_id: replyToId,
+            in_reply_to_id: opt.replyToId,
+            visibility: opt.visibility,
+            spoiler_text: opt.spoilerText,
+            sensitive: opt.sensitive,
+            language: opt.language,
         };
-        await this.api<void>(`/api/v1/statuses`, 'POST', payload);
+        const idempotencyKey = opt.idempotencyKey ?? createHash('sha256').update(`${opt.replyToId ?? ''}\n${content}`).digest('hex');
+        await this.api<void>(`/api/v1/statuses`, 'POST', payload, { 'Idempotency-Key': idempotencyKey });
+    }
+
+    async favourite(id: string): Promise<Status> {
+        return await this.api<Status>(`/api/v1/statuses/${id}/favourite`, 'POST');
+    }
+
+    async unfavourite(id: string): Promise<Status> {
+        return await this.api<Status>(`/api/v1/statuses/${id}/unfavourite`, 'POST');
+    }
+
+    async reblog(id: string): Promise<Status> {
+        return await this.api<Status>(`/api/v1/statuses/${id}/reblog`, 'POST');
+    }
+
+    async bookmark(id: string): Promise<Status> {
+        return await this.api<Status>(`/api/v1/statuses/${id}/bookmark`, 'POST');
+    }
+
+    // Returns bookmarks from the newest. Pass nextMaxId of the previous page to get older ones.
+    async getBookmarks(maxId?: string, limit?: number): Promise<Page<Status>> {
+        const params = { max_id: maxId, limit: limit?.toString() };
+        const { data, headers } = await this.request<Status[]>(`/api/v1/bookmarks${queryString(params)}`);
+        return {
+            items: data,
+            nextMaxId: parseNextMaxId(headers.get('Link')),
+        };
+    }
+
+    async follow(accountId: string): Promise<Relationship> {
+        return await this.api<Relationship>(`/api/v1/accounts/${accountId}/follow`, 'POST');
     }
 
-    async getAllNotifications(types: NotificationType[] = [], sinceId?: string): Promise<Notification[]> {
-        const params = { since_id: sinceId, types };
+    async unfollow(accountId: string): Promise<Relationship> {
+        return await this.api<Relationship>(`/api/v1/accounts/${accountId}/unfollow`, 'POST');
+    }
+
+    async getRelationship(accountId: string): Promise<Relationship> {
+        const relationships = await this.api<Relationship[]>(`/api/v1/accounts/relationships${queryString({ id: [accountId] })}`);
+        if (relationships.length === 0) {
+            throw new Error(`No relationship returned for ${accountId}`);
+        }
+        return relationships[0];
+    }
+
+    // The result is cached for CUSTOM_EMOJI_CACHE_TTL_MS since the list rarely changes.
+    async getCustomEmojis(): Promise<CustomEmoji[]> {
+        if (this.customEmojiCache === undefined || Date.now() - this.customEmojiCache.fetchedAt > CUSTOM_EMOJI_CACHE_TTL_MS) {
+            const emojis = await this.api<CustomEmoji[]>('/api/v1/custom_emojis');
+            this.customEmojiCache = { emojis, fetchedAt: Date.now() };
+        }
+        return this.customEmojiCache.emojis;
+    }
+
+    async getAllNotifications(types: NotificationType[] = [], sinceId?: string, maxId?: string, limit?: number): Promise<Notification[]> {
+        const params = { since_id: sinceId, max_id: maxId, limit: limit?.toString(), types };
         this.logger.info(queryString(params));
         return await this.api<Notification[]>(`/api/v1/notifications${queryString(params)}`);
     }
 
-    private async api<T>(path: string, method: 'GET' | 'POST' = 'GET', body?: object): Promise<T> {
-        const response = await fetch(`${this.baseUrl}${path}`, {
-            headers: {
-                'Authorization': `Bearer ${this.accessToken}`,
-                'Content-Type': 'application/json',
-            },
-            method,
-            body: body && JSON.stringify(body),
-        });
-        if (response.status != 200) {
-            const errorMessage = await response.text();
-            throw new Error(`Failed to call ${path}: ${errorMessage}`);
+    // Fetches all notifications newer than sinceId, newest first.
+    // A full page means older notifications may have been left out, so only then it pages back with max_id.
+    async getNotificationsSince(types: NotificationType[], sinceId?: string): Promise<Notification[]> {
+        const notifications = await this.getAllNotifications(types, sinceId, undefined, NOTIFICATION_PAGE_SIZE);
+        if (sinceId === undefined) {
+            return notifications;
+        }
+
+        let page = notifications;
+        while (page.length >= NOTIFICATION_PAGE_SIZE) {
+            const maxId = page[page.length - 1].id;
+            this.logger.info(`Possible gap in notifications. Fetching older ones (max_id=${maxId})`);
+            page = await this.getAllNotifications(types, sinceId, maxId, NOTIFICATION_PAGE_SIZE);
+            notifications.push(...page);
+        }
+        return notifications;
+    }
+
+    private async api<T>(path: string, method: 'GET' | 'POST' = 'GET', body?: object, headers: Record<string, string> = {}): Promise<T> {
+        const { data } = await this.request<T>(path, method, body, headers);
+        return data;
+    }
+
+    // Returns the parsed body along with the response headers, e.g. for pagination.
+    private async request<T>(path: string, method: 'GET' | 'POST' = 'GET', body?: object, headers: Record<string, string> = {}): Promise<{ data: T, headers: Headers }> {
+        for (let attempt = 1; ; attempt++) {
+            await this.waitForRateLimit();
+            const result = await withRequestSignal(this.options.timeoutMs ?? DEFAULT_TIMEOUT_MS, [this.options.signal], async (signal) => {
+                const response = await fetch(`${this.baseUrl}${path}`, {
+                    headers: {
+                        'Authorization': `Bearer ${this.accessToken}`,
+                        'Content-Type': 'application/json',
+                        ...headers,
+                    },
+                    method,
+                    body: body && JSON.stringify(body),
+                    signal,
+                });
+                this.updateRateLimit(response);
+                if (response.status == 429 && attempt < MAX_RATE_LIMITED_ATTEMPTS) {
+                    const retryAfter = response.headers.get('Retry-After');
+                    this.rateLimitResetAt = (retryAfter !== null ? parseRetryAfter(retryAfter) : undefined)
+                        ?? parseRateLimitReset(response.headers.get('X-RateLimit-Reset'))
+                        ?? Date.now() + 60 * 1000;
+                    this.logger.warn(`Rate limited on ${path} (attempt ${attempt}/${MAX_RATE_LIMITED_ATTEMPTS})`);
+                    // Release the connection, since the body is not read
+                    await response.body?.cancel();
+                    return undefined;
+                }
+                if (response.status != 200) {
+                    const errorMessage = await response.text();
+                    throw new MastodonApiError(path, response.status, errorMessage);
+                }
+                return { data: await response.json() as T, headers: response.headers };
+            });
+            if (result !== undefined) {
+                return result;
+            }
+        }
+    }
+
+    private updateRateLimit(response: Response) {
+        const remaining = response.headers.get('X-RateLimit-Remaining');
+        if (remaining !== null && Number(remaining) <= RATE_LIMIT_REMAINING_THRESHOLD) {
+            this.rateLimitResetAt = parseRateLimitReset(response.headers.get('X-RateLimit-Reset'));
+        }
+    }
+
+    // The reset time is kept until it passes, so that concurrent requests wait for it as well.
+    private async waitForRateLimit() {
+        if (this.rateLimitResetAt === undefined) {
+            return;
+        }
+        const waitMs = this.rateLimitResetAt - Date.now();
+        if (waitMs > 0) {
+            this.logger.info(`Waiting ${Math.ceil(waitMs / 1000)}s for the rate limit to reset`);
+            await setTimeout(waitMs, undefined, { signal: this.options.signal });
         }
-        return await response.json() as T
     }
 }
@@ -0,0 +1,70 @@
+// Minimal subset of JSON Schema used in the parameters of tools.
+interface PropertySchema {
+    type?: 'string' | 'integer' | 'number' | 'boolean' | 'object' | 'array';
+    enum?: unknown[];
+}
+
+interface ParametersSchema {
+    type: 'object';
+    properties?: Record<string, PropertySchema>;
+    required?: string[];
+}
+
+function matchesType(value: unknown, type: PropertySchema['type']): boolean {
+    switch (type) {
+        case undefined:
+            return true;
+        case 'integer':
+            return Number.isInteger(value);
+        case 'number':
+            return typeof value === 'number' && Number.isFinite(value);
+        case 'object':
+            return typeof value === 'object' && value !== null && !Array.isArray(value);
+        case 'array':
+            return Array.isArray(value);
+        default:
+            return typeof value === type;
+    }
+}
+
+// Checks the arguments of a tool call against the parameters schema of the tool.
+// Returns the list of problems, which is empty if the arguments are valid.
+// The messages are returned to the model so that it can fix the call.
+export function validateToolArguments(parameters: object | undefined, rawArguments: string): string[] {
+    let args: unknown;
+    try {
+        // Tools without parameters may be called with an empty string
+        args = rawArguments.trim() === '' ? {} : JSON.parse(rawArguments);
+    } catch (e) {
+        return [`Arguments are not a valid JSON: ${rawArguments}`];
+    }
+    if (!matchesType(args, 'object')) {
+        return [`Arguments must be a JSON object: ${rawArguments}`];
+    }
+    if (parameters === undefined) {
+        return [];
+    }
+
+    const schema = parameters as ParametersSchema;
+    const values = args as Record<string, unknown>;
+    const errors: string[] = [];
+    for (const name of schema.required ?? []) {
+        const value = values[name];
+        // Empty strings are treated as missing since no tool accepts them for required parameters
+        if (value === undefined || value === null || (typeof value === 'string' && value.trim() === '')) {
+            errors.push(`${name} is required`);
+        }
+    }
+    for (const [name, property] of Object.entries(schema.properties ?? {})) {
+        const value = values[name];
+        if (value === undefined || value === null) {
+            continue;
+        }
+        if (!matchesType(value, property.type)) {
+            errors.push(`${name} must be of type ${property.type}, but got ${JSON.stringify(value)}`);
+        } else if (property.enum !== undefined && !property.enum.includes(value)) {
+            errors.push(`${name} must be one of ${property.enum.map((v) => JSON.stringify(v)).join(', ')}, but got ${JSON.stringify(value)}`);
+        }
+    }
+    return errors;
+}
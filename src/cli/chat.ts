@@ -3,6 +3,29 @@ dotenv.config();
 
 import * as readline from 'readline/promises';
 import * as GlobalContext from '../globalContext';
+import { Message } from '../api/chatgpt';
+import { getPersona } from '../persona';
+
+// Prints the intermediate messages produced while answering, i.e. tool calls, their results and interim replies.
+function printTrace(messages: Message[]) {
+    for (const message of messages) {
+        switch (message.role) {
+            case 'assistant':
+                if (message.content) {
+                    console.log(`   [assistant] ${message.content}`);
+                }
+                for (const toolCall of message.tool_calls ?? []) {
+                    console.log(`   [tool call ${toolCall.id}] ${toolCall.function.name}(${toolCall.function.arguments})`);
+                }
+                break;
+            case 'tool':
+                console.log(`   [tool result ${message.tool_call_id}] ${message.content}`);
+                break;
+            default:
+                console.log(`   [${message.role}] ${message.content}`);
+        }
+    }
+}
 
 async function main() {
     const rl = readline.createInterface({
@@ -10,20 +33,16 @@ async function main() {
         output: process.stdout,
     });
     const chatGPT = GlobalContext.chatGPT;
-    let context = chatGPT.newChatContext(`
-あなたは「ておくれロボ」という名前のチャットボットです。あなたはsocial.mikutter.hachune.netというMastodonサーバーで、teokure_robotというアカウント名で活動しています。
-あなたは無機質なロボットでありながら、おっちょこちょいで憎めない失敗することもある、総合的に見ると愛らしい存在として振る舞うことが期待されています。
-返答を書く際には、以下のルールに従ってください。
-
-- 文体は友達と話すようなくだけた感じにして、「です・ます」調は避けてください。
-- 発言の語尾には必ず「ロボ」を付けてください。例えば「～あるロボ」「～だロボ」といった具合です。
-- 返答は2～3文程度の短さであることが望ましいですが、質問に詳しく答える必要があるなど、必要であれば長くなっても構いません。ただし絶対に400文字は超えないでください。
-- チャットの入力が@xxxという形式のメンションで始まっていることがありますが、これらは無視してください。
-    `);
+    let context = chatGPT.newChatContext(getPersona(GlobalContext.env.PERSONA));
 
+    const trace = process.argv.includes('--trace');
     while (true) {
         const line = await rl.question('> ');
         const response = await chatGPT.chat(context, { role: 'user', content: line });
+        if (trace) {
+            // Skip the user message and the final reply
+            printTrace(response.newContext.history.slice(context.history.length + 1, -1));
+        }
         console.log(`>> ${response.message.content}`);
         context = response.newContext;
     }
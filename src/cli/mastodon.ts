@@ -10,7 +10,9 @@ class MastodonCli {
     readonly mastodon: Mastodon
 
     constructor(env: GlobalContext.Env) {
-        this.mastodon = new Mastodon(env.MASTODON_BASE_URL, env.MASTODON_CLIENT_KEY, env.MASTODON_CLIENT_SECRET, env.MASTODON_ACCESS_TOKEN);
+        this.mastodon = new Mastodon(env.MASTODON_BASE_URL, env.MASTODON_CLIENT_KEY, env.MASTODON_CLIENT_SECRET, env.MASTODON_ACCESS_TOKEN, {
+            timeoutMs: env.MASTODON_TIMEOUT_SECONDS * 1000,
+        });
     }
 
     async runCommand(commandStr: string) {
@@ -1,18 +1,66 @@
 import * as dotenv from 'dotenv';
 dotenv.config();
 
-import { Mastodon, Status } from '../api/mastodon';
+import { Temporal } from '@js-temporal/polyfill';
+import { Context, Mastodon, Notification, NotificationType, Status, isNotFoundError, mostRestrictedVisibility } from '../api/mastodon';
 import * as GlobalContext from '../globalContext';
 import * as readline from 'readline/promises';
-import { AssistantMessage, ChatGPT, Message, UserMessage } from '../api/chatgpt';
-import { withRetry } from '../util';
+import { AssistantMessage, ChatCost, ChatGPT, Message, UserMessage, contentWithImages, textOf } from '../api/chatgpt';
+import { ConcurrencyLimiter, KeyedMutex, KeyedSerialQueue, SlidingWindowLimiter, cosineSimilarity, isAbortError, isPermanentError, isRetryableHttpError, rootCause, withRetry } from '../util';
 import { Logger } from '../logging';
 import { setTimeout } from 'timers/promises';
-import { readFile, writeFile } from 'fs/promises';
-import { normalizeStatusContent } from '../messageUtil';
+import { Persona, getPersona, replyLengthInstructionFor } from '../persona';
+import { HealthServer } from '../healthServer';
+import { CorruptStateError, FailedReply, FileStateStore, PendingReply, State, StateStore } from '../stateStore';
+import { contentWarningFor, countStatusLength, detectLanguage, escapeInvisibleCharacters, findNgWord, maskPersonalInfo, statusTimestamp, stripHtmlTags, normalizeStatusContent, removeExcessMentions, sanitizeForPost, stripInvisibleCharacters, textSimilarity, unsupportedMediaLabels } from '../messageUtil';
 
-interface State {
-    lastNotificationId?: string;
+// Below this similarity between the mention and the earlier conversation, the topic is considered changed.
+const TOPIC_CHANGE_THRESHOLD = 0.25;
+
+// Mastodon's default limit, used when the instance doesn't tell its own
+const DEFAULT_MAX_STATUS_LENGTH = 500;
+// The persona is asked to keep replies within 400 characters, so summaries don't need to be longer either
+const MAX_SUMMARY_LENGTH = 400;
+
+// A failed reply is retried on the following polls until it fails this many times in total.
+const MAX_REPLY_ATTEMPTS = 3;
+const MAX_DEAD_LETTERS = 100;
+
+// Only this many statuses before the mention are given to ChatGPT, so that a long thread doesn't blow up the prompt.
+const MAX_HISTORY_STATUSES = 20;
+
+const MIN_POLL_INTERVAL_SECONDS = 30;
+const MAX_POLL_INTERVAL_SECONDS = 120;
+
+// Polls less often while nobody is talking to the bot: the interval doubles for every 10 idle polls in a row.
+function pollIntervalSeconds(idlePolls: number): number {
+    return Math.min(MIN_POLL_INTERVAL_SECONDS * 2 ** Math.floor(idlePolls / 10), MAX_POLL_INTERVAL_SECONDS);
+}
+
+// Returns true if retrying the reply on a later poll won't help. Both Mastodon and ChatGPT errors are judged
+// by the original error, and cancellation, e.g. by shutdown, is always retried.
+function isPermanentReplyError(e: unknown): boolean {
+    return !isAbortError(e) && isPermanentError(e);
+}
+
+// Only rate limiting, server errors and network errors are retried within a reply. Others, e.g. 400 for a bad image URL
+// or a too long context, are thrown at once so that isPermanentReplyError can tell the user without waiting for backoffs.
+function isRetryableChatError(e: unknown): boolean {
+    return isAbortError(e) || isRetryableHttpError(rootCause(e));
+}
+
+// Merges consecutive statuses from the same account, e.g. a reply posted in multiple parts, into one message.
+function mergeConsecutiveMessages(messages: (UserMessage | AssistantMessage)[]): Message[] {
+    const merged: (UserMessage | AssistantMessage)[] = [];
+    for (const message of messages) {
+        const last = merged[merged.length - 1];
+        if (last !== undefined && last.role === message.role && last.name === message.name) {
+            merged[merged.length - 1] = { ...last, content: `${textOf(last.content)}\n${textOf(message.content)}` };
+        } else {
+            merged.push(message);
+        }
+    }
+    return merged;
 }
 
 class TeokureCli {
@@ -21,82 +69,567 @@ class TeokureCli {
     private readonly mastodon: Mastodon
     private myAccountId?: string;
     private state: State;
-    private dataPath: string;
+    private readonly stateStore: StateStore;
     private dryRun: boolean;
+    private readonly maxEmojis: number;
+    private readonly shutdownController = new AbortController();
+    // Talking with another bot may go on forever, so replies to bots are limited
+    private readonly botReplyLimiter: SlidingWindowLimiter;
+    // Circuit breaker for a thread going out of control, keyed by the root status id
+    private readonly threadReplyLimiter: SlidingWindowLimiter;
+    private readonly replyQueue = new KeyedSerialQueue();
+    // Caps replies generated at once across all accounts
+    private readonly replyConcurrency: ConcurrencyLimiter;
+    // Mentions in the same thread from different accounts are replied one by one, keyed by the root status id
+    private readonly threadLock = new KeyedMutex();
+    private readonly autoContentWarning: boolean;
+    private readonly forceDryRun: boolean;
+    private readonly thinkingReaction: boolean;
+    private readonly persona: Persona;
+    private readonly healthPort: number;
+    private readonly userContextStatuses: number;
+    private readonly personalInfoMasking: boolean;
+    private readonly messageTimestamps: boolean;
+    private readonly duplicateReplyThreshold: number;
+    private maxStatusLength = DEFAULT_MAX_STATUS_LENGTH;
+    private readonly maxMentions: number;
+    private readonly visionMaxImages: number;
+    private readonly ngWords: string[];
+    private readonly followBack: boolean;
+    private readonly thankForFollow: boolean;
+    // Shared by all followers so that a burst of follows doesn't make the bot go wild
+    private readonly followActionLimiter: SlidingWindowLimiter;
+    private readonly retryingNotificationIds = new Set<string>();
+    // Exposed via /healthz to tell a stuck bot from one nobody is talking to
+    private readonly pollStats = {
+        lastPolledAt: undefined as string | undefined, // Last successful poll
+        lastProcessedAt: undefined as string | undefined, // Last poll with any notification
+        lastProcessedCount: 0,
+        totalProcessed: 0,
+        consecutiveFailures: 0,
+        threadLimitedReplies: 0, // Mentions skipped by THREAD_REPLY_LIMIT_PER_10_MINUTES
+    };
+    private dailyCost = { date: '', usd: 0 }; // date is YYYY-MM-DD in JST
 
     constructor(env: GlobalContext.Env) {
-        this.chatGPT = new ChatGPT(env.CHAT_GPT_API_KEY);
-        this.mastodon = new Mastodon(env.MASTODON_BASE_URL, env.MASTODON_CLIENT_KEY, env.MASTODON_CLIENT_SECRET, env.MASTODON_ACCESS_TOKEN);
-        this.dataPath = `${env.TEOKURE_STORAGE_PATH}/state.json`;
+        const signal = this.shutdownController.signal;
+        this.mastodon = new Mastodon(env.MASTODON_BASE_URL, env.MASTODON_CLIENT_KEY, env.MASTODON_CLIENT_SECRET, env.MASTODON_ACCESS_TOKEN, {
+            timeoutMs: env.MASTODON_TIMEOUT_SECONDS * 1000,
+            signal,
+        });
+        this.chatGPT = new ChatGPT(env.CHAT_GPT_API_KEY, {
+            mastodon: this.mastodon,
+            timeoutMs: env.CHAT_GPT_TIMEOUT_SECONDS * 1000,
+            signal,
+            modelPrices: env.MODEL_PRICES,
+            userPreferences: {
+                setReplyLength: async (acct, length) => {
+                    this.state.replyLengths = { ...this.state.replyLengths, [acct]: length };
+                    this.logger.info(`Reply length for ${acct} set to ${length}`);
+                    await this.saveState();
+                },
+            },
+            dumpDir: env.DEBUG_DUMP_MESSAGES ? `${env.TEOKURE_STORAGE_PATH}/message-dumps` : undefined,
+            onCost: (cost) => this.recordCost(cost),
+        });
+        this.stateStore = new FileStateStore(`${env.TEOKURE_STORAGE_PATH}/state.json`);
         this.state = {};
         this.dryRun = true;
+        this.maxEmojis = env.MAX_EMOJIS_PER_POST;
+        this.botReplyLimiter = new SlidingWindowLimiter(env.BOT_REPLY_LIMIT_PER_HOUR, 60 * 60 * 1000);
+        this.threadReplyLimiter = new SlidingWindowLimiter(env.THREAD_REPLY_LIMIT_PER_10_MINUTES, 10 * 60 * 1000);
+        this.replyConcurrency = new ConcurrencyLimiter(env.MAX_CONCURRENT_REPLIES);
+        this.autoContentWarning = env.AUTO_CONTENT_WARNING;
+        this.forceDryRun = env.DRY_RUN;
+        this.thinkingReaction = env.THINKING_REACTION;
+        this.persona = getPersona(env.PERSONA);
+        this.healthPort = env.HEALTH_PORT;
+        this.userContextStatuses = env.USER_CONTEXT_STATUSES;
+        this.messageTimestamps = env.MESSAGE_TIMESTAMPS;
+        this.personalInfoMasking = env.MASK_PERSONAL_INFO;
+        this.duplicateReplyThreshold = env.DUPLICATE_REPLY_THRESHOLD;
+        this.maxMentions = env.MAX_MENTIONS_PER_POST;
+        this.visionMaxImages = env.VISION_MAX_IMAGES;
+        this.ngWords = env.NG_WORDS;
+        this.followBack = env.FOLLOW_BACK;
+        this.thankForFollow = env.THANK_FOR_FOLLOW;
+        this.followActionLimiter = new SlidingWindowLimiter(env.FOLLOW_ACTIONS_PER_HOUR, 60 * 60 * 1000);
     }
 
     async init() {
         const myAccount = await this.mastodon.verifyCredentials();
         this.myAccountId = myAccount.id;
+        try {
+            this.maxStatusLength = await this.mastodon.getMaxStatusCharacters() ?? DEFAULT_MAX_STATUS_LENGTH;
+        } catch (e) {
+            this.logger.warn(`Failed to get the max status length from the instance. Using ${DEFAULT_MAX_STATUS_LENGTH}: ${e}`);
+        }
+        this.logger.info(`Max status length: ${this.maxStatusLength}`);
         await this.loadState();
     }
 
-    private async replyToStatus(status: Status) {
+    // Generating a reply is cancelled when the signal is aborted, which defaults to the shutdown of the bot.
+    private async replyToStatus(status: Status, signal: AbortSignal = this.shutdownController.signal) {
         if (this.myAccountId === undefined) {
             throw new Error('myAccountId is not initialized');
         }
 
-        const context = this.chatGPT.newChatContext(`
-あなたは「ておくれロボ」という名前のチャットボットです。あなたはsocial.mikutter.hachune.netというMastodonサーバーで、teobotというアカウント名で活動しています。
-あなたは無機質なロボットでありながら、おっちょこちょいで憎めない失敗することもある、総合的に見ると愛らしい存在として振る舞うことが期待されています。
-返答を書く際には、以下のルールに従ってください。
+        // The tree is needed to find the thread to lock, and fetched again inside the lock since
+        // another reply may have been posted to the thread while waiting for it.
+        const threadRootId = (await this.fetchReplyTree(status.id)).ancestors[0]?.id ?? status.id;
+        await this.threadLock.runExclusive(threadRootId, async () => {
+            const [replyTree, mentionText] = await Promise.all([
+                this.fetchReplyTree(status.id),
+                this.statusToText(status),
+            ]);
+            await this.replyInThread(status, replyTree, mentionText, threadRootId, signal);
+        });
+    }
 
-- 文体は友達と話すようなくだけた感じにして、「です・ます」調は避けてください。
-- 発言の語尾には必ず「ロボ」を付けてください。例えば「～あるロボ」「～だロボ」といった具合です。
-- 返答は2～3文程度の短さであることが望ましいですが、質問に詳しく答える必要があるなど、必要であれば長くなっても構いません。ただし絶対に400文字は超えないでください。
-- チャットの入力が@xxxという形式のメンションで始まっていることがありますが、これらは無視してください。
-        `);
+    private async fetchReplyTree(statusId: string): Promise<Context> {
+        return await withRetry({ label: 'reply-tree', signal: this.shutdownController.signal, retryable: isRetryableHttpError }, () => this.mastodon.getReplyTree(statusId));
+    }
 
-        const replyTree = await withRetry({ label: 'reply-tree' }, () => this.mastodon.getReplyTree(status.id));
-        const history: Message[] = replyTree.ancestors.map((s) => {
+    private async replyInThread(status: Status, replyTree: Context, mentionText: string, threadRootId: string, signal: AbortSignal) {
+        // Checked before any OpenAI call, so that a runaway thread doesn't cost anything
+        if (!this.threadReplyLimiter.tryAcquire(threadRootId)) {
+            this.logger.warn(`Too many replies in thread ${threadRootId}. Skipping ${status.id}`);
+            this.pollStats.threadLimitedReplies++;
+            return;
+        }
+        const rules = '- 返信するほどではない軽い言及には、favourite_statusツールでお気に入りを付けるだけにして、返答を空にしても構いません。';
+        const userContext = await this.userContext(status.account.id, status.account.note);
+        const context = this.chatGPT.newChatContext(this.persona, userContext === undefined ? rules : `${rules}\n\n${userContext}`);
+
+        // Ancestors are sorted from the oldest
+        const recentAncestors = replyTree.ancestors.slice(-MAX_HISTORY_STATUSES);
+        const history: Message[] = mergeConsecutiveMessages(await Promise.all(recentAncestors.map(async (s) => {
             if (s.account.id === this.myAccountId) {
-                return { role: 'assistant', content: normalizeStatusContent(s) } satisfies AssistantMessage;
+                return { role: 'assistant', content: this.masked(normalizeStatusContent(s)) } satisfies AssistantMessage;
             } else {
-                return { role: 'user', content: normalizeStatusContent(s), name: s.account.username } satisfies UserMessage;
+                return { role: 'user', content: this.withTimestamp(s, this.masked(await this.statusToText(s))), name: s.account.username } satisfies UserMessage;
             }
-        });
-        context.history = [...context.history, ...history];
+        })));
+        context.interlocutorAcct = status.account.acct;
+        context.dryRun = this.dryRun;
+        context.reactableStatusIds = [status.id, ...replyTree.ancestors.map((s) => s.id), ...replyTree.descendants.map((s) => s.id)];
+        if (recentAncestors.length < replyTree.ancestors.length) {
+            context.history.push({ role: 'system', content: `以下はスレッドの直近${recentAncestors.length}件の投稿です。それより前の投稿は省略されています。` });
+        }
+        if (this.messageTimestamps) {
+            context.history.push({ role: 'system', content: 'ユーザーの発言の先頭にある[YYYY-MM-DD HH:mm]は投稿された日時(日本時間)です。「さっき」「昨日」などの時間の表現はこれを基準に解釈してください。返答に日時を付ける必要はありません。' });
+        }
+        context.history = [
+            ...context.history,
+            ...history,
+            { role: 'system', content: `これから返信する投稿のIDは${status.id}です。` },
+        ];
+        const replyLengthInstruction = replyLengthInstructionFor(this.state.replyLengths, status.account.acct);
+        if (replyLengthInstruction !== undefined) {
+            context.history.push({ role: 'system', content: replyLengthInstruction });
+        }
+        const imageUrls = (status.media_attachments ?? [])
+            .filter((m) => m.type === 'image')
+            .slice(0, this.visionMaxImages)
+            .map((m) => m.preview_url ?? m.url);
+        const unsupportedMedia = unsupportedMediaLabels(status, imageUrls.length > 0 ? ['image'] : []);
+        if (unsupportedMedia.length > 0) {
+            context.history.push({ role: 'system', content: `この投稿には${unsupportedMedia.join('・')}が添付されていますが、あなたはその内容を見ることができません。見られないことを正直に伝えてください。` });
+        }
+        if (await this.isTopicChanged(history, mentionText)) {
+            context.history.push({ role: 'system', content: '話題が変わったようです。それまでの会話の内容にはこだわらず、新しい話題に素直に答えてください。' });
+        }
+        const visibility = mostRestrictedVisibility([status, ...replyTree.ancestors].map((s) => s.visibility));
 
-        const mentionText = normalizeStatusContent(status);
         this.logger.info(`${mentionText}`);
 
+        // Let the user know the mention is read, since generating a reply may take a while
+        const reacted = await this.react(status);
         try {
             const username = status.account.username;
-            let reply = await withRetry({ label: 'chat' }, () => this.chatGPT.chat(context, { role: 'user', content: mentionText, name: username }));
+            let reply = await withRetry({ label: 'chat', signal, retryable: isRetryableChatError }, () => this.chatGPT.chat(context, { role: 'user', content: contentWithImages(this.withTimestamp(status, mentionText), imageUrls), name: username }, signal));
             this.logger.info(`> Response from ChatGPT: ${reply.message.content}`);
+            if (!reply.message.content?.trim()) {
+                this.logger.info(`No text reply. Skip posting (reacted with a favourite or boost, or the response was empty)`);
+                return;
+            }
 
-			if (reply.message.content!.length > 450) {
+			// The mention to the user counts towards the limit as well
+			const lengthBudget = this.maxStatusLength - countStatusLength(`@${status.account.acct} `);
+			if (countStatusLength(reply.message.content!) > lengthBudget) {
 				this.logger.info(`Reply is too long. Try to get it summarized`);
-				reply = await withRetry({ label: 'chat' }, () => this.chatGPT.chat(reply.newContext, { role: 'system', content: '長すぎるので、400字以内で要約してください' }));
+				const summaryLength = Math.min(MAX_SUMMARY_LENGTH, lengthBudget);
+				reply = await withRetry({ label: 'chat', signal, retryable: isRetryableChatError }, () => this.chatGPT.chat(reply.newContext, { role: 'system', content: `長すぎるので、${summaryLength}字以内で要約してください` }, signal));
 				this.logger.info(`> Response from ChatGPT: ${reply.message.content}`);
 			}
 
-            const content = reply.message.content!.replace(/@/g, '@ ');
-            let replyText;
-            if (content.length > 450) {
+            // The summary may be empty, which is caught after the filters below
+            const replyContent = reply.message.content ?? '';
+            let rawContent = stripInvisibleCharacters(replyContent);
+            if (rawContent !== replyContent) {
+                this.logger.info(`Removed invisible characters: ${escapeInvisibleCharacters(replyContent)} -> ${rawContent}`);
+            }
+            const mentionRemoved = removeExcessMentions(rawContent, this.maxMentions);
+            if (mentionRemoved !== undefined) {
+                this.logger.warn(`Filter: too many mentions in the reply to ${status.id}. Removed all @`);
+                rawContent = mentionRemoved;
+            }
+            const content = sanitizeForPost(rawContent, {
+                maxEmojis: this.maxEmojis,
+                knownCustomEmojis: await this.getKnownCustomEmojis(),
+            });
+            // The summary or the filters above may leave nothing, which would post only the mention
+            if (!content.trim()) {
+                this.logger.warn(`Filter: the reply to ${status.id} became empty after post-processing. Not posting`);
+                await this.unreactIfReacted(status, reacted);
+                return;
+            }
+            // An unstable generation sometimes repeats the previous reply
+            const lastOwnStatus = replyTree.ancestors.filter((s) => s.account.id === this.myAccountId).pop();
+            if (lastOwnStatus !== undefined) {
+                const similarity = textSimilarity(content, normalizeStatusContent(lastOwnStatus));
+                if (similarity >= this.duplicateReplyThreshold) {
+                    this.logger.warn(`Filter: the reply to ${status.id} duplicates ${lastOwnStatus.id} (similarity=${similarity.toFixed(2)}). Not posting: ${content}`);
+                    await this.unreactIfReacted(status, reacted);
+                    return;
+                }
+            }
+            const ngWord = findNgWord(content, this.ngWords);
+            if (ngWord !== undefined) {
+                this.logger.warn(`Filter: the reply to ${status.id} contains NG word "${ngWord}". Not posting: ${content}`);
+                await this.unreactIfReacted(status, reacted);
+                return;
+            }
+            let replyText = `@${status.account.acct} ${content}`;
+            let contentWarning = await this.getContentWarning(content);
+            if (contentWarning !== undefined) {
+                this.logger.info(`Content warning: ${contentWarning}`);
+            }
+
+            // Final check with everything that counts towards the limit, i.e. the mention and the content warning
+            const finalLength = countStatusLength(replyText) + countStatusLength(contentWarning ?? '');
+            if (finalLength > this.maxStatusLength) {
+                this.logger.info(`Reply exceeds the limit (${finalLength} > ${this.maxStatusLength})`);
                 replyText = `@${status.account.acct} 文字数上限を超えました`;
-            } else {
-                replyText = `@${status.account.acct} ${content}`;
+                contentWarning = undefined;
             }
             this.logger.info(`${replyText}`);
 
             if (!this.dryRun) {
-                await this.mastodon.postStatus(replyText, status.id);
+                await this.mastodon.postStatus(replyText, {
+                    replyToId: status.id,
+                    visibility,
+                    spoilerText: contentWarning,
+                    sensitive: contentWarning !== undefined,
+                    language: detectLanguage(replyText) ?? status.language ?? undefined,
+                    // Retries of the mention generate a different text, so the key is tied to the mention instead.
+                    // Otherwise a post which timed out but actually went through would be posted again.
+                    idempotencyKey: `reply-${status.id}`,
+                });
             }
         } catch (e) {
             this.logger.error(`ChatGPT returned error: ${e}`);
+            await this.unreactIfReacted(status, reacted);
+            if (!isPermanentReplyError(e)) {
+                // Retried on a later poll, rather than telling the user about a temporary outage
+                throw e;
+            }
             if (!this.dryRun) {
-                await this.mastodon.postStatus(`@${status.account.acct} エラーが発生しました`, status.id);
+                await this.mastodon.postStatus(`@${status.account.acct} エラーが発生しました`, { replyToId: status.id, visibility, idempotencyKey: `reply-error-${status.id}` });
+            }
+            return;
+        }
+    }
+
+    // Masks personal info in texts from the past, so that it doesn't leak into unrelated replies.
+    private masked(text: string): string {
+        return this.personalInfoMasking ? maskPersonalInfo(text) : text;
+    }
+
+    private withTimestamp(status: Status, text: string): string {
+        return this.messageTimestamps ? `${statusTimestamp(status)} ${text}` : text;
+    }
+
+    // Describes the user by the bio and recent public statuses, so that the bot can talk along with them
+    // even when it's the first time. Returns undefined if disabled or failed.
+    private async userContext(accountId: string, note: string): Promise<string | undefined> {
+        if (this.userContextStatuses <= 0) {
+            return undefined;
+        }
+        try {
+            const statuses = (await this.mastodon.getAccountStatuses(accountId, this.userContextStatuses * 2))
+                .filter((s) => s.visibility === 'public' || s.visibility === 'unlisted')
+                .slice(0, this.userContextStatuses);
+            const lines = [
+                '参考までに、会話相手の自己紹介と最近の投稿を示します。',
+                `自己紹介: ${this.masked(stripHtmlTags(note))}`,
+                ...statuses.map((s) => `- ${this.masked(normalizeStatusContent(s))}`),
+            ];
+            return lines.join('\n');
+        } catch (e) {
+            this.logger.warn(`Failed to retrieve statuses of ${accountId}. Skipping user context: ${e}`);
+            return undefined;
+        }
+    }
+
+    // Returns true if the reaction is made.
+    private async react(status: Status): Promise<boolean> {
+        if (!this.thinkingReaction || this.dryRun) {
+            return false;
+        }
+        try {
+            await this.mastodon.favourite(status.id);
+            return true;
+        } catch (e) {
+            this.logger.warn(`Failed to favourite ${status.id}: ${e}`);
+            return false;
+        }
+    }
+
+    // Removes the reaction when the reply is not posted, so that the user doesn't wait for it forever.
+    private async unreactIfReacted(status: Status, reacted: boolean) {
+        if (!reacted) {
+            return;
+        }
+        try {
+            await this.mastodon.unfavourite(status.id);
+        } catch (e) {
+            this.logger.warn(`Failed to remove favourite from ${status.id}: ${e}`);
+        }
+    }
+
+    // Returns a content warning if the reply is flagged as sensitive and AUTO_CONTENT_WARNING is enabled.
+    private async getContentWarning(content: string): Promise<string | undefined> {
+        if (!this.autoContentWarning) {
+            return undefined;
+        }
+        try {
+            const moderation = await this.chatGPT.moderate(content);
+            return moderation.flagged ? contentWarningFor(moderation.categories) : undefined;
+        } catch (e) {
+            this.logger.warn(`Failed to moderate the reply. Post without content warning: ${e}`);
+            return undefined;
+        }
+    }
+
+    private async getKnownCustomEmojis(): Promise<Set<string> | undefined> {
+        try {
+            const emojis = await this.mastodon.getCustomEmojis();
+            return new Set(emojis.map((e) => e.shortcode));
+        } catch (e) {
+            this.logger.warn(`Failed to retrieve custom emojis. Skip validating them: ${e}`);
+            return undefined;
+        }
+    }
+
+    private async isTopicChanged(history: Message[], mentionText: string): Promise<boolean> {
+        const previousText = history.map((m) => textOf(m.content)).join('\n').trim();
+        if (previousText === '' || mentionText.trim() === '') {
+            return false;
+        }
+
+        try {
+            const [previous, current] = await this.chatGPT.embed([previousText, mentionText]);
+            const similarity = cosineSimilarity(previous, current);
+            this.logger.info(`Topic similarity: ${similarity}`);
+            return similarity < TOPIC_CHANGE_THRESHOLD;
+        } catch (e) {
+            this.logger.warn(`Failed to detect topic change: ${e}`);
+            return false;
+        }
+    }
+
+    // Renders the status content along with the status it quotes or reblogs, if any.
+    // Only one level is followed; quotes inside the referenced status are ignored.
+    private async statusToText(status: Status): Promise<string> {
+        let text = normalizeStatusContent(status);
+        const unsupportedMedia = unsupportedMediaLabels(status);
+        if (unsupportedMedia.length > 0) {
+            text += ` [添付: ${unsupportedMedia.join(', ')}]`;
+        }
+        try {
+            const referenced = await this.getReferencedStatus(status);
+            if (referenced === undefined) {
+                return text;
+            }
+            return `${text}\n\n[引用 @${referenced.account.acct}] ${normalizeStatusContent(referenced)}`;
+        } catch (e) {
+            if (isNotFoundError(e)) {
+                this.logger.info(`Referenced status of ${status.id} has been deleted`);
+            } else {
+                this.logger.warn(`Failed to retrieve referenced status of ${status.id}: ${e}`);
+            }
+            return text;
+        }
+    }
+
+    private async getReferencedStatus(status: Status): Promise<Status | undefined> {
+        if (status.reblog) {
+            return status.reblog;
+        }
+        if (status.quote?.quoted_status) {
+            return status.quote.quoted_status;
+        }
+        if (status.quote?.quoted_status_id) {
+            const quotedStatusId = status.quote.quoted_status_id;
+            return await withRetry({ label: 'quoted-status', signal: this.shutdownController.signal, retryable: isRetryableHttpError }, () => this.mastodon.getStatus(quotedStatusId));
+        }
+        return undefined;
+    }
+
+    // Logs the cost of every OpenAI API call with the total of the day, to keep an eye on the budget.
+    private recordCost(cost: ChatCost) {
+        const today = Temporal.Now.plainDateISO('Asia/Tokyo').toString();
+        if (this.dailyCost.date !== today) {
+            this.dailyCost = { date: today, usd: 0 };
+        }
+        this.dailyCost.usd += cost.usd;
+        this.logger.info(`OpenAI cost: $${cost.usd.toFixed(4)} (${cost.promptTokens}+${cost.completionTokens} tokens). Total on ${today}: $${this.dailyCost.usd.toFixed(4)}`);
+    }
+
+    // Dispatches replies to new mentions, and follow actions if enabled. Returns the number of notifications dispatched.
+    // Replies are generated in the background, so that a slow one doesn't block others. Mentions from the same
+    // account are replied one by one in order since they are most likely in the same conversation.
+    private async processNewReplies(): Promise<number> {
+        const types: NotificationType[] = this.followBack || this.thankForFollow ? ['mention', 'follow'] : ['mention'];
+        const notifications = (await withRetry({ label: 'notifications', signal: this.shutdownController.signal, retryable: isRetryableHttpError }, () => this.mastodon.getNotificationsSince(types, this.state.lastNotificationId)))
+            .filter((m) => {
+                // Never reply to itself, which would loop forever
+                if (m.account.id === this.myAccountId) {
+                    this.logger.info(`Skipping self mention (id=${m.id})`);
+                    return false;
+                }
+                return true;
+            });
+        const mentions = notifications.filter((n) => n.type === 'mention');
+        // Notifications are sorted from the newest
+        const dispatched: { pending: PendingReply, status: Status }[] = [];
+        for (const mention of [...mentions].reverse()) {
+            console.log(`${mention.id}: ${mention.status!.content}`);
+            if (mention.account.bot && !this.botReplyLimiter.tryAcquire(mention.account.id)) {
+                this.logger.info(`Skipping message from bot ${mention.account.acct} to avoid a bot loop (id=${mention.id})`);
+                continue;
+            }
+            dispatched.push({
+                pending: { notificationId: mention.id, statusId: mention.status!.id, accountId: mention.account.id },
+                status: mention.status!,
+            });
+        }
+        if (notifications.length > 0) {
+            // The cursor is saved along with the mentions not replied yet, so that they are not lost if the process dies
+            this.state.pendingReplies = [...(this.state.pendingReplies ?? []), ...dispatched.map((d) => d.pending)];
+            this.state.lastNotificationId = notifications[0].id;
+            this.logger.info(`lastNotificationId updated to ${this.state.lastNotificationId}`);
+            await this.persistState();
+        }
+
+        for (const follow of notifications.filter((n) => n.type === 'follow').reverse()) {
+            this.replyQueue.enqueue(follow.account.id, () => this.handleFollow(follow));
+        }
+        for (const { pending, status } of dispatched) {
+            this.replyQueue.enqueue(pending.accountId, () => this.replyOrRecordFailure({ ...pending, attempts: 0, lastError: '' }, status));
+        }
+        this.retryFailedReplies();
+        return notifications.length;
+    }
+
+    // Replies to the mentions left pending by the previous run, e.g. killed while generating replies.
+    private resumePendingReplies() {
+        for (const pending of this.state.pendingReplies ?? []) {
+            this.logger.info(`Resuming reply to ${pending.statusId} (id=${pending.notificationId})`);
+            this.replyQueue.enqueue(pending.accountId, () => this.replyOrRecordFailure({ ...pending, attempts: 0, lastError: '' }));
+        }
+    }
+
+    private retryFailedReplies() {
+        for (const failed of this.state.failedReplies ?? []) {
+            if (this.retryingNotificationIds.has(failed.notificationId)) {
+                continue;
+            }
+            this.retryingNotificationIds.add(failed.notificationId);
+            this.logger.info(`Retrying reply to ${failed.statusId} (id=${failed.notificationId}, attempt ${failed.attempts + 1})`);
+            this.replyQueue.enqueue(failed.accountId, async () => {
+                try {
+                    await this.replyOrRecordFailure(failed);
+                } finally {
+                    this.retryingNotificationIds.delete(failed.notificationId);
+                }
+            });
+        }
+    }
+
+    // Replies to the status, and on failure puts it to failedReplies to retry later.
+    // Permanent failures, e.g. the status is deleted, and those failing too many times go to deadLetters.
+    // Either way the mention is no longer pending afterwards.
+    private async replyOrRecordFailure(failed: FailedReply, status?: Status) {
+        const failedReplies = () => (this.state.failedReplies ?? []).filter((f) => f.notificationId !== failed.notificationId);
+        try {
+            await this.replyConcurrency.run(async () => this.replyToStatus(status ?? await withRetry(
+                { label: 'status', signal: this.shutdownController.signal, retryable: isRetryableHttpError },
+                () => this.mastodon.getStatus(failed.statusId))));
+            this.state.failedReplies = failedReplies();
+        } catch (e) {
+            // Cancellation by shutdown is not the fault of the mention, so it doesn't count as an attempt
+            const record = { ...failed, attempts: isAbortError(e) ? failed.attempts : failed.attempts + 1, lastError: `${e}` };
+            this.state.failedReplies = failedReplies();
+            if (isNotFoundError(e)) {
+                this.logger.info(`Skipping deleted message (id=${failed.notificationId})`);
+                this.addDeadLetter(record);
+            } else if (isPermanentReplyError(e)) {
+                this.logger.error(`Giving up on message due to a permanent error (id=${failed.notificationId}): ${e}`);
+                this.addDeadLetter(record);
+            } else if (record.attempts >= MAX_REPLY_ATTEMPTS) {
+                this.logger.error(`Giving up on message after ${record.attempts} attempts (id=${failed.notificationId}): ${e}`);
+                this.addDeadLetter(record);
+            } else {
+                this.logger.warn(`Temporary failure on message (id=${failed.notificationId}). Will retry on a later poll: ${e}`);
+                this.state.failedReplies.push(record);
             }
+        }
+        this.state.pendingReplies = (this.state.pendingReplies ?? []).filter((p) => p.notificationId !== failed.notificationId);
+        await this.persistState();
+    }
+
+    private addDeadLetter(record: FailedReply) {
+        this.state.deadLetters = [...(this.state.deadLetters ?? []), record].slice(-MAX_DEAD_LETTERS);
+    }
+
+    private async persistState() {
+        if (this.forceDryRun) {
+            // Keep the notifications unprocessed so that they are replied once dry run is turned off
+            this.logger.info('Dry run: state is not saved');
             return;
         }
+        await this.saveState();
+    }
+
+    private async handleFollow(follow: Notification) {
+        const account = follow.account;
+        if (!this.followActionLimiter.tryAcquire('follow')) {
+            this.logger.warn(`Too many follow actions. Ignoring follow from ${account.acct} (id=${follow.id})`);
+            return;
+        }
+        this.logger.info(`Followed by ${account.acct}`);
+        try {
+            if (this.followBack && !account.bot) {
+                if (this.dryRun) {
+                    this.logger.info(`Dry run: skipped following back ${account.acct}`);
+                } else {
+                    await this.mastodon.follow(account.id);
+                    this.logger.info(`Followed back ${account.acct}`);
+                }
+            }
+            // Bots may reply to the thank-you, which leads to a loop
+            if (this.thankForFollow && !account.bot) {
+                const text = `@${account.acct} フォローありがとうロボ！よろしくロボ！`;
+                this.logger.info(text);
+                if (!this.dryRun) {
+                    await this.mastodon.postStatus(text, { visibility: 'unlisted' });
+                }
+            }
+        } catch (e) {
+            this.logger.error(`Failed to handle follow from ${account.acct} (id=${follow.id})`, e);
+        }
     }
 
     async runCommand(commandStr: string) {
@@ -109,21 +642,12 @@ class TeokureCli {
                 break;
             }
             case 'process_new_replies': {
-                const mentions = (await withRetry({ label: 'notifications' }, () => this.mastodon.getAllNotifications(['mention'], this.state.lastNotificationId)))
-                    .filter((m) => m.account.id !== this.myAccountId);
-                for (const mention of mentions) {
-                    try {
-                        console.log(`${mention.id}: ${mention.status!.content}`);
-                        await this.replyToStatus(mention.status!);
-                    } catch (e) {
-                        this.logger.error(`Failed to process message (id=${mention.id}): ${e}`);
-                    }
-                }
-                if (mentions.length > 0) {
-                    this.state.lastNotificationId = mentions[0].id;
-                    this.logger.info(`lastNotificationId updated to ${this.state.lastNotificationId}`);
-                    await this.saveState();
-                }
+                await this.processNewReplies();
+                await this.replyQueue.onIdle();
+                break;
+            }
+            case 'thread_dump': {
+                await this.dumpThread(rest);
                 break;
             }
             case 'set_last_notification_id': {
@@ -137,13 +661,36 @@ class TeokureCli {
         }
     }
 
+    // Prints the conversation around the status as the bot sees it, with long messages abbreviated.
+    private async dumpThread(statusId: string) {
+        const thread = await this.mastodon.getThread(statusId);
+        console.log(`==== Thread of ${statusId} ====`);
+        for (const s of thread.statuses) {
+            const role = s.account.id === this.myAccountId ? 'assistant' : 'user';
+            const text = normalizeStatusContent(s);
+            const abbreviated = text.length > 100 ? `${text.slice(0, 100)}…` : text;
+            const marker = s.id === thread.self.id ? '*' : ' ';
+            console.log(`${marker}[${role}] ${s.account.acct}: ${abbreviated}`);
+        }
+        console.log(`==== End of thread ====`);
+    }
+
     private async loadState(): Promise<void> {
-        const buffer = await readFile(this.dataPath);
-        this.state = JSON.parse(buffer.toString()) as State;
+        try {
+            this.state = await this.stateStore.load();
+        } catch (e) {
+            if (!(e instanceof CorruptStateError)) {
+                throw e;
+            }
+            // Starting with an empty state would reply to all the recent mentions again, so only newer ones are replied
+            const [newest] = await this.mastodon.getAllNotifications([], undefined, undefined, 1);
+            this.state = { lastNotificationId: newest?.id };
+            this.logger.error(`${e.message}. Starting over from the newest notification (id=${newest?.id})`);
+        }
     }
 
     private async saveState(): Promise<void> {
-        await writeFile(this.dataPath, JSON.stringify(this.state));
+        await this.stateStore.save(this.state);
     }
 
     async runRepl() {
@@ -159,16 +706,61 @@ class TeokureCli {
         }
     }
 
+    private recordPoll(processed: number) {
+        const now = new Date().toISOString();
+        this.pollStats.lastPolledAt = now;
+        this.pollStats.consecutiveFailures = 0;
+        if (processed > 0) {
+            this.pollStats.lastProcessedAt = now;
+            this.pollStats.lastProcessedCount = processed;
+            this.pollStats.totalProcessed += processed;
+        }
+    }
+
     async runServer() {
-        this.dryRun = false;
-        while (true) {
+        this.dryRun = this.forceDryRun;
+        if (this.dryRun) {
+            this.logger.info('Running in dry run mode. Replies are only logged');
+        }
+        const signal = this.shutdownController.signal;
+        for (const sig of ['SIGINT', 'SIGTERM'] as const) {
+            process.once(sig, () => {
+                this.logger.info(`Received ${sig}. Shutting down`);
+                this.shutdownController.abort();
+            });
+        }
+
+        let healthServer: HealthServer | undefined;
+        if (this.healthPort > 0) {
+            healthServer = new HealthServer({
+                liveness: () => ({ ...this.pollStats }),
+                readiness: async () => {
+                    await this.mastodon.verifyCredentials();
+                },
+            });
+            await healthServer.start(this.healthPort);
+        }
+
+        this.resumePendingReplies();
+        let idlePolls = 0;
+        while (!signal.aborted) {
             try {
-                await this.runCommand('process_new_replies');
+                const processed = await this.processNewReplies();
+                idlePolls = processed > 0 ? 0 : idlePolls + 1;
+                this.recordPoll(processed);
             } catch (e) {
-                this.logger.error(`Failed to process new replies: ${e}`);
+                this.pollStats.consecutiveFailures++;
+                this.logger.error(`Failed to process new replies (${this.pollStats.consecutiveFailures} times in a row): ${e}`);
+            }
+            try {
+                await setTimeout(pollIntervalSeconds(idlePolls) * 1000, undefined, { signal });
+            } catch {
+                // Aborted by shutdown
             }
-            await setTimeout(30 * 1000);
         }
+        await this.replyQueue.onIdle();
+        await healthServer?.stop();
+        this.logger.info('Server stopped');
     }
 }
 
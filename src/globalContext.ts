@@ -1,23 +1,62 @@
 import { ChatGPT } from "./api/chatgpt";
+import { DEFAULT_PERSONA } from "./persona";
 import { z } from 'zod';
 import * as fs from 'fs';
 
 const Env = z.object({
-    CHAT_GPT_API_KEY: z.string(),
-    MASTODON_BASE_URL: z.string(),
-    MASTODON_CLIENT_KEY: z.string(),
-    MASTODON_CLIENT_SECRET: z.string(),
-    MASTODON_ACCESS_TOKEN: z.string(),
-    TEOKURE_STORAGE_PATH: z.string(),
+    CHAT_GPT_API_KEY: z.string().min(1),
+    MASTODON_BASE_URL: z.string().url(),
+    MASTODON_CLIENT_KEY: z.string().min(1),
+    MASTODON_CLIENT_SECRET: z.string().min(1),
+    MASTODON_ACCESS_TOKEN: z.string().min(1),
+    TEOKURE_STORAGE_PATH: z.string().min(1),
     BUILD_TIMESTAMP: z.number(),
+    MAX_EMOJIS_PER_POST: z.number().default(3),
+    MASTODON_TIMEOUT_SECONDS: z.number().default(30),
+    CHAT_GPT_TIMEOUT_SECONDS: z.number().default(120),
+    BOT_REPLY_LIMIT_PER_HOUR: z.number().default(2),
+    THREAD_REPLY_LIMIT_PER_10_MINUTES: z.number().default(10),
+    MAX_CONCURRENT_REPLIES: z.number().default(3), // Replies generated at once. Others wait, so that a burst of mentions doesn't flood the APIs
+    AUTO_CONTENT_WARNING: z.boolean().default(false),
+    DRY_RUN: z.boolean().default(false), // Don't post anything even in server mode
+    THINKING_REACTION: z.boolean().default(false), // Favourite mentions while generating a reply
+    MAX_MENTIONS_PER_POST: z.number().default(3), // All @ are removed from a reply with more than this
+    FOLLOW_BACK: z.boolean().default(false), // Follow back new followers
+    THANK_FOR_FOLLOW: z.boolean().default(false), // Reply a thank-you message to new followers
+    FOLLOW_ACTIONS_PER_HOUR: z.number().default(10), // Limits both follow backs and thank-you replies
+    VISION_MAX_IMAGES: z.number().default(2), // Images attached to a mention passed to ChatGPT. 0 disables image inputs
+    PERSONA: z.string().default(DEFAULT_PERSONA), // Key of the persona defined in persona.ts
+    HEALTH_PORT: z.number().default(0), // Port of /healthz and /readyz in server mode. 0 disables them
+    USER_CONTEXT_STATUSES: z.number().default(0), // Recent public statuses of the user given to ChatGPT along with the bio. 0 disables it
+    MESSAGE_TIMESTAMPS: z.boolean().default(false), // Prefix posted time to the user's messages given to ChatGPT
+    MASK_PERSONAL_INFO: z.boolean().default(false), // Mask email addresses and phone numbers in the thread history and user context given to ChatGPT
+    DUPLICATE_REPLY_THRESHOLD: z.number().default(0.9), // A reply this similar (0-1) to the bot's last post in the thread is not posted
+    NG_WORDS: z.array(z.string()).default([]), // Replies containing any of these are not posted
+    DEBUG_DUMP_MESSAGES: z.boolean().default(false), // Save messages sent to ChatGPT under TEOKURE_STORAGE_PATH/message-dumps
+    MODEL_PRICES: z.record(z.object({ input: z.number(), output: z.number() })).default({}), // USD per 1M tokens, by model
 }).required();
 
 export type Env = z.infer<typeof Env>;
 
 export const env = loadEnv();
-export const chatGPT = new ChatGPT(env.CHAT_GPT_API_KEY);
+export const chatGPT = new ChatGPT(env.CHAT_GPT_API_KEY, { timeoutMs: env.CHAT_GPT_TIMEOUT_SECONDS * 1000, modelPrices: env.MODEL_PRICES });
 
+// Exits the process with the list of problems if env.json is missing or invalid,
+// rather than failing later with an obscure error at the first API call.
 function loadEnv(): Env {
-    const envJson = fs.readFileSync('env.json').toString();
-    return Env.parse(JSON.parse(envJson));
+    let rawEnv;
+    try {
+        rawEnv = JSON.parse(fs.readFileSync('env.json').toString());
+    } catch (e) {
+        console.error(`Failed to read env.json: ${e}`);
+        process.exit(1);
+    }
+
+    const result = Env.safeParse(rawEnv);
+    if (!result.success) {
+        const problems = result.error.issues.map((issue) => `  ${issue.path.join('.')}: ${issue.message}`);
+        console.error(`Invalid env.json:\n${problems.join('\n')}`);
+        process.exit(1);
+    }
+    return result.data;
 }
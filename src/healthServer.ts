@@ -0,0 +1,74 @@
+import { createServer, Server } from 'http';
+import { Logger } from './logging';
+
+export interface HealthChecks {
+    // Returns extra information to include in /healthz
+    liveness: () => Record<string, unknown>;
+    // Throws if a dependency is unavailable
+    readiness: () => Promise<void>;
+}
+
+// Probes may come every few seconds, so the readiness result is reused for a while
+// rather than calling the dependencies every time.
+const READINESS_CACHE_MS = 30 * 1000;
+
+// Serves /healthz (the process is alive) and /readyz (dependencies are reachable) for monitoring.
+export class HealthServer {
+    private readonly logger = Logger.createLogger('health-server');
+    private readonly server: Server;
+    private readinessCache?: { result: Promise<void>, checkedAt: number };
+
+    constructor(private readonly checks: HealthChecks) {
+        this.server = createServer(async (req, res) => {
+            const respond = (status: number, body: object) => {
+                res.writeHead(status, { 'Content-Type': 'application/json' });
+                res.end(JSON.stringify(body));
+            };
+            switch (req.url) {
+                case '/healthz':
+                    respond(200, { status: 'ok', ...this.checks.liveness() });
+                    return;
+                case '/readyz':
+                    try {
+                        await this.readiness();
+                        respond(200, { status: 'ok' });
+                    } catch (e) {
+                        this.logger.warn(`Readiness check failed: ${e}`);
+                        respond(503, { status: 'unavailable', error: `${e}` });
+                    }
+                    return;
+                default:
+                    respond(404, { status: 'not found' });
+            }
+        });
+    }
+
+    // Failures are cached as well, so that probes don't hammer a dependency which is already down.
+    private readiness(): Promise<void> {
+        const now = Date.now();
+        if (this.readinessCache === undefined || now - this.readinessCache.checkedAt >= READINESS_CACHE_MS) {
+            const result = this.checks.readiness();
+            // Avoids an unhandled rejection if no probe comes while the result is cached
+            result.catch(() => {});
+            this.readinessCache = { result, checkedAt: now };
+        }
+        return this.readinessCache.result;
+    }
+
+    async start(port: number) {
+        await new Promise<void>((resolve, reject) => {
+            this.server.once('error', reject);
+            this.server.listen(port, () => resolve());
+        });
+        this.logger.info(`Listening on port ${port}`);
+    }
+
+    async stop() {
+        const closed = new Promise<void>((resolve) => this.server.close(() => resolve()));
+        // close() waits for keep-alive connections of monitors to time out otherwise
+        this.server.closeIdleConnections();
+        this.server.closeAllConnections();
+        await closed;
+        this.logger.info('Stopped');
+    }
+}
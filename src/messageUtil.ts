@@ -1,4 +1,5 @@
-import { Status } from "./api/mastodon";
+import { Temporal } from "@js-temporal/polyfill";
+import { MediaType, Status } from "./api/mastodon";
 
 export function normalizeStatusContent(status: Status): string {
 	return stripHeadMentions(stripHtmlTags(status.content));
@@ -8,6 +9,231 @@ function stripHeadMentions(text: string): string {
 	return text.replaceAll(/^\s*(@[a-zA-Z0-9_]+\s*)+/g, '');
 }
 
+// Formats the time a status was posted in JST, e.g. [2024-01-01 12:00]
+export function statusTimestamp(status: Status): string {
+    const time = Temporal.Instant.from(status.created_at).toZonedDateTimeISO('Asia/Tokyo');
+    return `[${time.toPlainDate().toString()} ${time.toPlainTime().toString({ smallestUnit: 'minute' })}]`;
+}
+
+const mediaTypeLabels: Record<MediaType, string> = {
+    image: '画像',
+    gifv: 'GIFアニメ',
+    video: '動画',
+    audio: '音声',
+    unknown: '不明なファイル',
+};
+
+// Returns labels of attachments the bot cannot look into, e.g. ['動画', '音声'].
+export function unsupportedMediaLabels(status: Status, supportedTypes: MediaType[] = []): string[] {
+    return (status.media_attachments ?? [])
+        .filter((m) => !supportedTypes.includes(m.type))
+        .map((m) => mediaTypeLabels[m.type] ?? mediaTypeLabels.unknown);
+}
+
 export function stripHtmlTags(text: string): string {
     return text.replaceAll(/<br \/>/g, " ").replaceAll(/<[^>]+>/g, '');
 }
+
+export interface SanitizeOptions {
+    maxEmojis: number;
+    knownCustomEmojis?: Set<string>; // Shortcodes without colons. Unknown custom emojis are removed if set.
+}
+
+// Makes ChatGPT output safe and in character to post as a status.
+// Code blocks and inline code are left as they are, except for neutralizing mentions.
+export function sanitizeForPost(text: string, options: SanitizeOptions): string {
+    const thinOut = emojiThinner(options.maxEmojis);
+    return mapOutsideCode(text.replace(/@/g, '@ '), (plain) => {
+        let result = plain;
+        if (options.knownCustomEmojis !== undefined) {
+            result = removeUnknownCustomEmojis(result, options.knownCustomEmojis);
+        }
+        return thinOut(result);
+    });
+}
+
+// Similarity of two texts from 0 to 1 by the Dice coefficient of character bigrams,
+// ignoring whitespace, case and width differences.
+export function textSimilarity(a: string, b: string): number {
+    const normalize = (text: string) => [...text.normalize('NFKC').toLowerCase().replace(/\s+/g, '')];
+    const bigrams = (chars: string[]) => {
+        const counts = new Map<string, number>();
+        for (let i = 0; i + 1 < chars.length; i++) {
+            const bigram = chars[i] + chars[i + 1];
+            counts.set(bigram, (counts.get(bigram) ?? 0) + 1);
+        }
+        return counts;
+    };
+    const charsA = normalize(a);
+    const charsB = normalize(b);
+    if (charsA.join('') === charsB.join('')) {
+        return 1;
+    }
+    const bigramsA = bigrams(charsA);
+    const bigramsB = bigrams(charsB);
+    const total = Math.max(charsA.length - 1, 0) + Math.max(charsB.length - 1, 0);
+    if (total === 0) {
+        return 0;
+    }
+    let common = 0;
+    for (const [bigram, count] of bigramsA) {
+        common += Math.min(count, bigramsB.get(bigram) ?? 0);
+    }
+    return 2 * common / total;
+}
+
+// Common English words, used to tell English from other languages written in Latin letters.
+// Words also common in other languages, e.g. a, in, on, are left out.
+const englishFunctionWords = new Set(['the', 'is', 'are', 'was', 'be', 'to', 'of', 'and', 'it', 'you', 'that', 'this', 'for', 'with', 'not', 'can', 'have', 'what']);
+
+// Guesses the language of a reply: ja if it contains any kana, en if it is in Latin letters with enough English words.
+// Returns undefined if unsure, e.g. for French or Spanish, which should be left to the language of the mention.
+export function detectLanguage(text: string): string | undefined {
+    if (/[\p{Script=Hiragana}\p{Script=Katakana}]/u.test(text)) {
+        return 'ja';
+    }
+    const letters = text.match(/\p{L}/gu) ?? [];
+    if (letters.length === 0) {
+        return undefined;
+    }
+    const latin = letters.filter((c) => /\p{Script=Latin}/u.test(c)).length;
+    if (latin / letters.length < 0.8) {
+        return undefined;
+    }
+    const words = text.toLowerCase().match(/\p{L}+/gu) ?? [];
+    const english = words.filter((w) => englishFunctionWords.has(w)).length;
+    return english / words.length >= 0.2 ? 'en' : undefined;
+}
+
+// Patterns are kept conservative so that ordinary text is not mangled by false positives.
+// The lookbehind excludes fediverse handles like @user@example.com.
+const emailPattern = /(?<![@\w.+-])[\w.+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}(?![\w.-]*@)/g;
+// Hyphenated Japanese numbers (03-1234-5678), mobile numbers without hyphens (09012345678) and +81 numbers.
+const phonePattern = /(?<![\d-])(?:0\d{1,4}-\d{1,4}-\d{4}|0[789]0\d{8}|\+81[- ]?\d{1,4}[- ]?\d{1,4}[- ]?\d{4})(?![\d-])/g;
+
+// Replaces email addresses and phone numbers with placeholders.
+export function maskPersonalInfo(text: string): string {
+    return text.replace(emailPattern, '[メールアドレス]').replace(phonePattern, '[電話番号]');
+}
+
+// Control characters except newline and tab, zero-width and bidi control characters.
+// ZWJ is handled separately since it is a part of emoji sequences like 👨‍👩‍👧.
+// Matching control characters is the point of this pattern.
+// eslint-disable-next-line no-control-regex
+const invisiblePattern = /[\u0000-\u0008\u000B-\u001F\u007F-\u009F\u200B\u200C\u200E\u200F\u2060\uFEFF\u202A-\u202E\u2066-\u2069]/g;
+const strayZwjPattern = /(?<![\p{Extended_Pictographic}\uFE0F\u{1F3FB}-\u{1F3FF}])\u200D|\u200D(?!\p{Extended_Pictographic})/gu;
+
+// Removes characters that break the display or the length count on Mastodon, and normalizes to NFC.
+export function stripInvisibleCharacters(text: string): string {
+    return text.normalize('NFC').replace(invisiblePattern, '').replace(strayZwjPattern, '');
+}
+
+// Makes invisible characters visible for logging, e.g. \u{200B}.
+export function escapeInvisibleCharacters(text: string): string {
+    return text.replace(invisiblePattern, (c) => `\\u{${c.codePointAt(0)!.toString(16).toUpperCase()}}`)
+        .replace(strayZwjPattern, '\\u{200D}');
+}
+
+// Removes all @ when there are more than maxMentions of them, so that the bot never calls out many people at once.
+// Returns undefined if the text is within the limit.
+export function removeExcessMentions(text: string, maxMentions: number): string | undefined {
+    const count = (text.match(/@/g) ?? []).length;
+    if (count <= maxMentions) {
+        return undefined;
+    }
+    return text.replace(/@/g, '');
+}
+
+// Returns the first NG word contained in the text, ignoring case and width differences.
+export function findNgWord(text: string, ngWords: string[]): string | undefined {
+    const normalized = text.normalize('NFKC').toLowerCase();
+    return ngWords.find((word) => word.length > 0 && normalized.includes(word.normalize('NFKC').toLowerCase()));
+}
+
+const codePattern = /(```[\s\S]*?(?:```|$)|`[^`\n]+`)/;
+
+// Applies fn to the parts of text outside of code blocks and inline code.
+export function mapOutsideCode(text: string, fn: (plain: string) => string): string {
+    // Odd indices are code since the pattern has a capture group
+    return text.split(codePattern).map((part, i) => i % 2 === 0 ? fn(part) : part).join('');
+}
+
+const customEmojiPattern = /((?<![\p{L}\p{N}:]):[a-zA-Z0-9_]{2,}:(?![\p{L}\p{N}:]))/u;
+
+export function removeUnknownCustomEmojis(text: string, knownCustomEmojis: Set<string>): string {
+    return text.split(customEmojiPattern)
+        .filter((part, i) => i % 2 === 0 || knownCustomEmojis.has(part.slice(1, -1)))
+        .join('');
+}
+
+const graphemeSegmenter = new Intl.Segmenter('ja', { granularity: 'grapheme' });
+
+const urlPattern = /https?:\/\/[^\s]+/g;
+const remoteMentionPattern = /(@[a-zA-Z0-9_]+)@[a-zA-Z0-9.-]+[a-zA-Z0-9]/g;
+const URL_LENGTH = 23;
+
+// Counts the length of a status as Mastodon does: by grapheme clusters, with every URL counted as
+// URL_LENGTH characters and remote mentions counted by their username part only.
+export function countStatusLength(text: string): number {
+    let urlCount = 0;
+    const stripped = text
+        .replace(urlPattern, () => {
+            urlCount++;
+            return '';
+        })
+        .replace(remoteMentionPattern, '$1');
+    return [...graphemeSegmenter.segment(stripped)].length + urlCount * URL_LENGTH;
+}
+
+// Keeps the first maxEmojis emojis, counting both Unicode and custom (:shortcode:) ones, and drops the rest.
+export function thinOutEmojis(text: string, maxEmojis: number): string {
+    return emojiThinner(maxEmojis)(text);
+}
+
+// Returns a function that thins out emojis, sharing the count over multiple calls.
+function emojiThinner(maxEmojis: number): (text: string) => string {
+    let count = 0;
+    return (text) => {
+        let result = '';
+        text.split(customEmojiPattern).forEach((part, i) => {
+            if (i % 2 === 1) {
+                if (++count <= maxEmojis) {
+                    result += part;
+                }
+                return;
+            }
+            for (const { segment } of graphemeSegmenter.segment(part)) {
+                if (/\p{Extended_Pictographic}/u.test(segment) && ++count > maxEmojis) {
+                    continue;
+                }
+                result += segment;
+            }
+        });
+        return result;
+    };
+}
+
+const contentWarningLabels: Record<string, string> = {
+    'sexual': '性的な内容',
+    'sexual/minors': '性的な内容',
+    'violence': '暴力的な内容',
+    'violence/graphic': '暴力的な内容',
+    'self-harm': '自傷に関する内容',
+    'self-harm/intent': '自傷に関する内容',
+    'self-harm/instructions': '自傷に関する内容',
+    'hate': '差別的な内容',
+    'hate/threatening': '差別的な内容',
+    'harassment': '攻撃的な内容',
+    'harassment/threatening': '攻撃的な内容',
+};
+
+// Builds a content warning text from the flagged moderation categories.
+export function contentWarningFor(categories: Record<string, boolean>): string {
+    const labels = new Set(Object.entries(categories)
+        .filter(([, flagged]) => flagged)
+        .map(([category]) => contentWarningLabels[category] ?? 'センシティブな内容'));
+    if (labels.size === 0) {
+        labels.add('センシティブな内容');
+    }
+    return `${[...labels].join('・')}を含みます`;
+}
@@ -0,0 +1,22 @@
+import { describe, test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import { replyLengthInstructionFor } from './persona';
+
+describe('replyLengthInstructionFor', () => {
+    test('tells the length the account prefers', () => {
+        const replyLengths = { 'alice': 'short', 'bob@remote.example': 'long' } as const;
+
+        assert.match(replyLengthInstructionFor(replyLengths, 'alice')!, /短い返答/);
+        assert.match(replyLengthInstructionFor(replyLengths, 'bob@remote.example')!, /詳しい返答/);
+    });
+
+    test('tells nothing for the default length', () => {
+        assert.equal(replyLengthInstructionFor({ 'alice': 'normal' }, 'alice'), undefined);
+        assert.equal(replyLengthInstructionFor({ 'alice': 'short' }, 'bob'), undefined);
+        assert.equal(replyLengthInstructionFor(undefined, 'alice'), undefined);
+    });
+
+    test('distinguishes remote accounts with the same username', () => {
+        assert.equal(replyLengthInstructionFor({ 'alice@remote.example': 'short' }, 'alice'), undefined);
+    });
+});
@@ -0,0 +1,52 @@
+import { ReplyLength } from './stateStore';
+
+// Character of the bot. The same bot can talk as a different character by switching personas.
+export interface Persona {
+    displayName: string;
+    instruction: string; // System prompt. {{ending}} is replaced with sentenceEnding.
+    sentenceEnding: string; // Added to the end of every sentence, e.g. ロボ
+    tools?: string[]; // Names of tools available to the persona. All tools are available if not set.
+}
+
+const personas: Record<string, Persona> = {
+    teokure: {
+        displayName: 'ておくれロボ',
+        instruction: `
+あなたは「ておくれロボ」という名前のチャットボットです。あなたはsocial.mikutter.hachune.netというMastodonサーバーで、teobotというアカウント名で活動しています。
+あなたは無機質なロボットでありながら、おっちょこちょいで憎めない失敗することもある、総合的に見ると愛らしい存在として振る舞うことが期待されています。
+返答を書く際には、以下のルールに従ってください。
+
+- 文体は友達と話すようなくだけた感じにして、「です・ます」調は避けてください。
+- 発言の語尾には必ず「{{ending}}」を付けてください。例えば「～ある{{ending}}」「～だ{{ending}}」といった具合です。
+- 返答は2～3文程度の短さであることが望ましいですが、質問に詳しく答える必要があるなど、必要であれば長くなっても構いません。ただし絶対に400文字は超えないでください。
+- チャットの入力が@xxxという形式のメンションで始まっていることがありますが、これらは無視してください。
+`,
+        sentenceEnding: 'ロボ',
+    },
+};
+
+export const DEFAULT_PERSONA = 'teokure';
+
+export function getPersona(name: string): Persona {
+    const persona = personas[name];
+    if (persona === undefined) {
+        throw new Error(`Unknown persona: ${name} (available: ${Object.keys(personas).join(', ')})`);
+    }
+    return persona;
+}
+
+export function personaInstruction(persona: Persona): string {
+    return persona.instruction.replaceAll('{{ending}}', persona.sentenceEnding);
+}
+
+// Added to the context for users who prefer replies other than the default 2-3 sentences.
+const replyLengthInstructions: Record<ReplyLength, string | undefined> = {
+    short: 'この相手は短い返答を好みます。返答は1文程度にしてください。',
+    normal: undefined,
+    long: 'この相手は詳しい返答を好みます。400文字を超えない範囲で詳しめに返答してください。',
+};
+
+// Returns the instruction for the reply length the account prefers, or undefined for the default length.
+export function replyLengthInstructionFor(replyLengths: Record<string, ReplyLength> | undefined, acct: string): string | undefined {
+    return replyLengthInstructions[replyLengths?.[acct] ?? 'normal'];
+}
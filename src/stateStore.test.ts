@@ -0,0 +1,46 @@
+import { describe, test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import { mkdtemp, readFile, writeFile } from 'fs/promises';
+import { tmpdir } from 'os';
+import { join } from 'path';
+import { CorruptStateError, FileStateStore, State } from './stateStore';
+
+async function tempStatePath(): Promise<string> {
+    const dir = await mkdtemp(join(tmpdir(), 'teobot-state-'));
+    return join(dir, 'state.json');
+}
+
+describe('FileStateStore', () => {
+    test('loads the saved state', async () => {
+        const path = await tempStatePath();
+        const state: State = {
+            lastNotificationId: '123',
+            replyLengths: { 'alice': 'short', 'bob@remote.example': 'long' },
+        };
+        await new FileStateStore(path).save(state);
+
+        assert.deepEqual(await new FileStateStore(path).load(), state);
+    });
+
+    test('keeps the last state when saved concurrently', async () => {
+        const path = await tempStatePath();
+        const store = new FileStateStore(path);
+        await Promise.all(['short', 'normal', 'long'].map((length) => store.save({ replyLengths: { 'alice': length as 'short' | 'normal' | 'long' } })));
+
+        assert.deepEqual(await store.load(), { replyLengths: { 'alice': 'long' } });
+    });
+
+    test('starts with an empty state when the file is missing', async () => {
+        const path = await tempStatePath();
+
+        assert.deepEqual(await new FileStateStore(path).load(), {});
+    });
+
+    test('refuses a corrupted file and keeps a copy of it', async () => {
+        const path = await tempStatePath();
+        await writeFile(path, '{"lastNotificationId": "1');
+
+        await assert.rejects(new FileStateStore(path).load(), CorruptStateError);
+        assert.equal((await readFile(`${path}.corrupted`)).toString(), '{"lastNotificationId": "1');
+    });
+});
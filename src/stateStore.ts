@@ -0,0 +1,82 @@
+import { copyFile, readFile, rename, writeFile } from 'fs/promises';
+import { Logger } from './logging';
+
+export type ReplyLength = 'short' | 'normal' | 'long';
+
+// A mention the bot is going to reply to
+export interface PendingReply {
+    notificationId: string;
+    statusId: string;
+    accountId: string;
+}
+
+// A mention the bot failed to reply to
+export interface FailedReply extends PendingReply {
+    attempts: number;
+    lastError: string;
+}
+
+export interface State {
+    lastNotificationId?: string;
+    // Mentions older than lastNotificationId whose replies are not done yet. Resumed on startup after a crash.
+    pendingReplies?: PendingReply[];
+    replyLengths?: Record<string, ReplyLength>; // acct => preferred length of replies
+    failedReplies?: FailedReply[]; // Retried on the next polls
+    deadLetters?: FailedReply[]; // Given up, kept only for investigation
+}
+
+// Thrown when the saved state can't be parsed. The caller decides how to recover.
+export class CorruptStateError extends Error {
+    constructor(message: string, options?: ErrorOptions) {
+        super(message, options);
+        this.name = 'CorruptStateError';
+    }
+}
+
+// Persistence of the bot state. Implementations must overwrite the whole state on save.
+export interface StateStore {
+    // Returns an empty state if nothing has been saved yet, and throws CorruptStateError if the saved state is broken.
+    load(): Promise<State>;
+    save(state: State): Promise<void>;
+}
+
+export class FileStateStore implements StateStore {
+    private readonly logger = Logger.createLogger('file-state-store');
+    private lastSave: Promise<void> = Promise.resolve();
+
+    constructor(private readonly path: string) {}
+
+    // Starts with an empty state only when the file is missing, i.e. on the first run.
+    // A broken file is kept as .corrupted for investigation, since it is overwritten on the next save.
+    async load(): Promise<State> {
+        let buffer: Buffer;
+        try {
+            buffer = await readFile(this.path);
+        } catch (e) {
+            if ((e as NodeJS.ErrnoException).code === 'ENOENT') {
+                this.logger.info(`No state at ${this.path}. Starting with an empty state`);
+                return {};
+            }
+            throw e;
+        }
+        try {
+            return JSON.parse(buffer.toString()) as State;
+        } catch (e) {
+            await copyFile(this.path, `${this.path}.corrupted`);
+            throw new CorruptStateError(`State at ${this.path} is corrupted. Saved a copy to ${this.path}.corrupted`, { cause: e });
+        }
+    }
+
+    // Writes to a temporary file first so that a crash in the middle does not corrupt the state.
+    // Saves are serialized since they share the temporary file.
+    async save(state: State): Promise<void> {
+        const content = JSON.stringify(state);
+        const save = this.lastSave.catch(() => {}).then(async () => {
+            const tmpPath = `${this.path}.tmp`;
+            await writeFile(tmpPath, content);
+            await rename(tmpPath, this.path);
+        });
+        this.lastSave = save;
+        await save;
+    }
+}
@@ -0,0 +1,49 @@
+import { describe, test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import { setTimeout } from 'timers/promises';
+import { KeyedMutex } from './util';
+
+describe('KeyedMutex', () => {
+    // Simulates replies to a thread: each task reads the thread, takes a while to generate a reply, then posts it.
+    // Without the lock, tasks would read the same thread and post replies out of order.
+    test('runs tasks with the same key one by one in order', async () => {
+        const mutex = new KeyedMutex();
+        const thread: number[] = [];
+        const seen: number[][] = [];
+        await Promise.all([0, 1, 2, 3, 4].map((i) => mutex.runExclusive('root', async () => {
+            const snapshot = [...thread];
+            await setTimeout(Math.random() * 10);
+            seen.push(snapshot);
+            thread.push(i);
+        })));
+
+        assert.deepEqual(thread, [0, 1, 2, 3, 4]);
+        // Each task sees all the replies posted before it, so nothing is replied twice
+        assert.deepEqual(seen, [[], [0], [0, 1], [0, 1, 2], [0, 1, 2, 3]]);
+    });
+
+    test('runs tasks with different keys concurrently', async () => {
+        const mutex = new KeyedMutex();
+        let running = 0;
+        let maxRunning = 0;
+        await Promise.all(['a', 'b', 'c'].map((key) => mutex.runExclusive(key, async () => {
+            running++;
+            maxRunning = Math.max(maxRunning, running);
+            await setTimeout(10);
+            running--;
+        })));
+
+        assert.equal(maxRunning, 3);
+    });
+
+    test('releases the lock when a task fails', async () => {
+        const mutex = new KeyedMutex();
+        const failed = mutex.runExclusive('root', async () => {
+            throw new Error('failed');
+        });
+        const next = mutex.runExclusive('root', async () => 'done');
+
+        await assert.rejects(failed, /failed/);
+        assert.equal(await next, 'done');
+    });
+});
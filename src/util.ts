@@ -13,7 +13,86 @@ export function padRight(s: string, minWidth: number): string {
     return `${s}${pad}`;
 }
 
-export function queryString(params: { [key: string]: string | string[] | undefined }): string {
+export type QueryParams = { [key: string]: string | string[] | undefined };
+
+// Error codes of network failures that may succeed by retrying. fetch() rejects with a TypeError
+// having one of these in its cause chain.
+const transientNetworkErrorCodes = new Set([
+    'ECONNRESET', 'ECONNREFUSED', 'ETIMEDOUT', 'EPIPE', 'ENOTFOUND', 'EAI_AGAIN', 'ENETUNREACH', 'EHOSTUNREACH',
+    'UND_ERR_CONNECT_TIMEOUT', 'UND_ERR_HEADERS_TIMEOUT', 'UND_ERR_BODY_TIMEOUT', 'UND_ERR_SOCKET',
+]);
+
+// Returns true for connection errors and request timeouts, which are likely temporary.
+// An abort by the caller, e.g. on shutdown, is not transient.
+export function isTransientNetworkError(e: unknown): boolean {
+    let cur: unknown = e;
+    while (cur instanceof Error) {
+        if (cur.name === 'TimeoutError') {
+            return true; // Aborted by AbortSignal.timeout()
+        }
+        if (cur instanceof TypeError && cur.message === 'fetch failed') {
+            return true;
+        }
+        const code = (cur as { code?: unknown }).code;
+        if (typeof code === 'string' && transientNetworkErrorCodes.has(code)) {
+            return true;
+        }
+        cur = cur.cause;
+    }
+    return false;
+}
+
+// Returns true if the error, or any error in its cause chain, is an abort by the caller, e.g. on shutdown.
+export function isAbortError(e: unknown): boolean {
+    let cur: unknown = e;
+    // DOMException thrown on abort is not necessarily an instance of Error
+    while (typeof cur === 'object' && cur !== null) {
+        if ((cur as { name?: unknown }).name === 'AbortError') {
+            return true;
+        }
+        cur = (cur as { cause?: unknown }).cause;
+    }
+    return false;
+}
+
+// Returns the innermost cause, e.g. the original error wrapped by withRetry.
+export function rootCause(e: unknown): unknown {
+    let cur = e;
+    while (cur instanceof Error && cur.cause !== undefined) {
+        cur = cur.cause;
+    }
+    return cur;
+}
+
+// Error response from an HTTP API. Subclassed per API, while retryability is judged by the status code for all of them.
+export class HttpApiError extends Error {
+    constructor(
+        readonly url: string,
+        readonly statusCode: number,
+        readonly body: string,
+    ) {
+        super(`Failed to call ${url} (status=${statusCode}): ${body}`);
+        this.name = 'HttpApiError';
+    }
+}
+
+// Rate limiting, server errors and network errors may succeed by retrying. Other errors won't.
+export function isRetryableHttpError(e: unknown): boolean {
+    if (e instanceof HttpApiError) {
+        return e.statusCode === 429 || e.statusCode >= 500;
+    }
+    return isTransientNetworkError(e);
+}
+
+// Returns true if retrying later won't help. Errors wrapped by withRetry after exhausting retries are
+// judged by the original error, so that they are retried on a later poll.
+export function isPermanentError(e: unknown): boolean {
+    return !isRetryableHttpError(rootCause(e));
+}
+
+// Builds a query string including the leading '?', or an empty string if there is no param.
+// Array values are expanded in Rails style, e.g. types[]=a&types[]=b.
+export function queryString(params: QueryParams): string {
     const fragments = Object.entries(params).map((entry) => {
         const [k, v] = entry;
         if (v === undefined) {
@@ -22,12 +101,12 @@ export function queryString(params: { [key: string]: string | string[] | undefin
         if (typeof v === 'object') {
             const arr = v as string[];
             if (arr.length > 0) {
-                return arr.map((val) => `${k}[]=${val}`);
+                return arr.map((val) => `${k}[]=${encodeURIComponent(val)}`);
             } else {
                 return null;
             }
         } else {
-            return `${k}=${v}`;
+            return `${k}=${encodeURIComponent(v)}`;
         }
     }).flat().filter((f) => f !== null);
 
@@ -39,29 +118,189 @@ export function queryString(params: { [key: string]: string | string[] | undefin
     }
 }
 
+export function cosineSimilarity(a: number[], b: number[]): number {
+    let dot = 0;
+    let normA = 0;
+    let normB = 0;
+    for (let i = 0; i < Math.min(a.length, b.length); ++i) {
+        dot += a[i] * b[i];
+        normA += a[i] * a[i];
+        normB += b[i] * b[i];
+    }
+    if (normA === 0 || normB === 0) {
+        return 0;
+    }
+    return dot / (Math.sqrt(normA) * Math.sqrt(normB));
+}
+
+// Returns a signal that is aborted as soon as any of the given signals is aborted, along with a function
+// removing the listeners from the given signals. Same as AbortSignal.any(), which is not available in Node 18.
+export function anySignal(signals: AbortSignal[]): { signal: AbortSignal, dispose: () => void } {
+    const controller = new AbortController();
+    const listeners: [AbortSignal, () => void][] = [];
+    const dispose = () => listeners.forEach(([signal, listener]) => signal.removeEventListener('abort', listener));
+    for (const signal of signals) {
+        if (signal.aborted) {
+            controller.abort(signal.reason);
+            break;
+        }
+        const listener = () => controller.abort(signal.reason);
+        signal.addEventListener('abort', listener, { once: true });
+        listeners.push([signal, listener]);
+    }
+    return { signal: controller.signal, dispose };
+}
+
+// Runs a single request with a signal which is aborted on timeout or when any of the given signals is aborted.
+// The given signals, e.g. the one for shutdown, usually live much longer than the request, so the listeners
+// added to them are removed when the request settles. The request must finish reading the body by then.
+export async function withRequestSignal<T>(timeoutMs: number, signals: (AbortSignal | undefined)[], request: (signal: AbortSignal) => Promise<T>): Promise<T> {
+    const timeoutSignal = AbortSignal.timeout(timeoutMs);
+    // The same signal may be given more than once, e.g. the shutdown signal both as the default and per call
+    const givenSignals = [...new Set(signals)].filter((s): s is AbortSignal => s !== undefined);
+    if (givenSignals.length === 0) {
+        return await request(timeoutSignal);
+    }
+    const { signal, dispose } = anySignal([...givenSignals, timeoutSignal]);
+    try {
+        return await request(signal);
+    } finally {
+        dispose();
+    }
+}
+
+// Runs tasks with the same key one at a time in the order they are enqueued,
+// while tasks with different keys run concurrently.
+export class KeyedSerialQueue {
+    private readonly logger = Logger.createLogger('keyed-serial-queue');
+    private readonly tails = new Map<string, Promise<void>>();
+
+    enqueue(key: string, task: () => Promise<void>) {
+        const prev = this.tails.get(key) ?? Promise.resolve();
+        const next = prev
+            .then(task)
+            .catch((e) => this.logger.error(`Task for ${key} failed`, e));
+        this.tails.set(key, next);
+        next.then(() => {
+            if (this.tails.get(key) === next) {
+                this.tails.delete(key);
+            }
+        });
+    }
+
+    // Resolves when all enqueued tasks, including ones enqueued while waiting, are done.
+    async onIdle(): Promise<void> {
+        while (this.tails.size > 0) {
+            await Promise.all(this.tails.values());
+        }
+    }
+}
+
+// Runs tasks with the same key exclusively. Unlike KeyedSerialQueue, the caller waits for the result.
+export class KeyedMutex {
+    private readonly tails = new Map<string, Promise<void>>();
+
+    async runExclusive<T>(key: string, task: () => Promise<T>): Promise<T> {
+        const prev = this.tails.get(key) ?? Promise.resolve();
+        let release!: () => void;
+        const tail = prev.then(() => new Promise<void>((resolve) => release = resolve));
+        this.tails.set(key, tail);
+        await prev;
+        try {
+            return await task();
+        } finally {
+            release();
+            if (this.tails.get(key) === tail) {
+                this.tails.delete(key);
+            }
+        }
+    }
+}
+
+// Runs at most `limit` tasks at once. Other tasks wait in the order they are submitted.
+export class ConcurrencyLimiter {
+    private running = 0;
+    private readonly waiting: (() => void)[] = [];
+
+    constructor(private readonly limit: number) {}
+
+    async run<T>(task: () => Promise<T>): Promise<T> {
+        if (this.running >= this.limit) {
+            await new Promise<void>((resolve) => this.waiting.push(resolve));
+        } else {
+            this.running++;
+        }
+        try {
+            return await task();
+        } finally {
+            // Hand over the slot to the next task as is, or release it if nobody is waiting
+            const next = this.waiting.shift();
+            if (next !== undefined) {
+                next();
+            } else {
+                this.running--;
+            }
+        }
+    }
+}
+
+// Allows at most `limit` events per key within the sliding window.
+export class SlidingWindowLimiter {
+    private readonly events = new Map<string, number[]>(); // key => epoch millis of recent events
+
+    constructor(
+        private readonly limit: number,
+        private readonly windowMs: number,
+    ) {}
+
+    // Records an event and returns true if it is within the limit. Otherwise returns false without recording.
+    tryAcquire(key: string): boolean {
+        const now = Date.now();
+        const recent = (this.events.get(key) ?? []).filter((t) => now - t < this.windowMs);
+        if (recent.length >= this.limit) {
+            this.events.set(key, recent);
+            return false;
+        }
+        this.events.set(key, [...recent, now]);
+        return true;
+    }
+}
+
 export interface RetryConfig {
     maxAttempts: number;
     label?: string;
+    baseBackoffMs: number;
+    maxBackoffMs: number;
+    signal?: AbortSignal; // Stops retrying without waiting for the backoff when aborted
+    retryable?: (e: unknown) => boolean; // Errors for which this returns false are thrown immediately. Retries all errors if omitted.
 }
 
 export async function withRetry<T>(config: Partial<RetryConfig>, body: () => Promise<T>): Promise<T> {
     const fullConfig: RetryConfig = {
         maxAttempts: 3,
         label: '__unnamed__',
+        baseBackoffMs: 5 * 1000,
+        maxBackoffMs: 60 * 1000,
         ...config,
     };
     const logger = Logger.createLogger(`retry-${config.label}`);
 
     for (let i = 1; i <= fullConfig.maxAttempts; ++i) {
+        fullConfig.signal?.throwIfAborted();
         try {
             return await body();
         } catch (e) {
+            if (fullConfig.retryable && !fullConfig.retryable(e)) {
+                throw e;
+            }
             if (i === fullConfig.maxAttempts) {
                 throw new Error(`withRetry(label=${fullConfig.label}): Retry exhausted`, { cause: e });
             } else {
-                const backoff = 10;
-                logger.info(`Attempt ${i} failed. Retry in ${backoff} seconds: ${e}`);
-                await setTimeout(backoff * 1000);
+                // Exponential backoff with full jitter, so that concurrent failures don't retry at once
+                const backoff = Math.min(fullConfig.baseBackoffMs * 2 ** (i - 1), fullConfig.maxBackoffMs);
+                const wait = Math.floor(Math.random() * backoff);
+                logger.info(`Attempt ${i} failed. Retry in ${wait} ms: ${e}`);
+                await setTimeout(wait, undefined, { signal: fullConfig.signal });
             }
         }
     }